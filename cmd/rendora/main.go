@@ -59,7 +59,97 @@ func main() {
 		},
 	}
 
+	var renderServerCmd = &cobra.Command{
+		Use:   "render-server",
+		Short: "Run a render server used by Rendora instances in the external headless mode",
+		Run: func(cmd *cobra.Command, args []string) {
+			Rendora, err := rendora.NewRenderServer(cfgFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			err = Rendora.RunRenderServer()
+
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	var sitemap, serverURL string
+	var warmCmd = &cobra.Command{
+		Use:   "warm",
+		Short: "Warm up the cache of a running Rendora instance by rendering all the pages listed in the sitemap",
+		Run: func(cmd *cobra.Command, args []string) {
+			err := rendora.Warm(cfgFile, sitemap, serverURL)
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	warmCmd.Flags().StringVar(&sitemap, "sitemap", "", "sitemap url of the target website or local sitemap file (default is warmup.sitemap in the config file)")
+	warmCmd.Flags().StringVar(&serverURL, "server", "", "Rendora API server url (default is derived from server.listen in the config file)")
+
+	var cacheCmd = &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the cache of a running Rendora instance",
+	}
+
+	var prefix, output string
+	var cacheExportCmd = &cobra.Command{
+		Use:   "export",
+		Short: "Export the cached pages of a running Rendora instance to a cache archive",
+		Run: func(cmd *cobra.Command, args []string) {
+			w := os.Stdout
+			if output != "" && output != "-" {
+				f, err := os.Create(output)
+				if err != nil {
+					log.Fatal(err)
+				}
+				defer f.Close()
+				w = f
+			}
+
+			err := rendora.ExportCache(cfgFile, serverURL, prefix, w)
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	cacheExportCmd.Flags().StringVarP(&output, "output", "o", "", "cache archive file (default is stdout)")
+	cacheExportCmd.Flags().StringVar(&prefix, "prefix", "", "export only the pages whose uris start with this prefix")
+	cacheExportCmd.Flags().StringVar(&serverURL, "server", "", "Rendora API server url (default is derived from server.listen in the config file)")
+
+	var input string
+	var cacheImportCmd = &cobra.Command{
+		Use:   "import",
+		Short: "Import the cached pages of a cache archive into a running Rendora instance",
+		Run: func(cmd *cobra.Command, args []string) {
+			r := os.Stdin
+			if input != "" && input != "-" {
+				f, err := os.Open(input)
+				if err != nil {
+					log.Fatal(err)
+				}
+				defer f.Close()
+				r = f
+			}
+
+			err := rendora.ImportCache(cfgFile, serverURL, r)
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	cacheImportCmd.Flags().StringVarP(&input, "input", "i", "", "cache archive file (default is stdin)")
+	cacheImportCmd.Flags().StringVar(&serverURL, "server", "", "Rendora API server url (default is derived from server.listen in the config file)")
+
+	cacheCmd.AddCommand(cacheExportCmd)
+	cacheCmd.AddCommand(cacheImportCmd)
+
 	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(cacheCmd)
+	rootCmd.AddCommand(warmCmd)
+	rootCmd.AddCommand(renderServerCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
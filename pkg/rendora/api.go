@@ -14,7 +14,11 @@ limitations under the License.
 package rendora
 
 import (
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -32,12 +36,17 @@ func (R *Rendora) apiRender(c *gin.Context) {
 		return
 	}
 
-	resp, err := R.getResponse(args.URI)
+	resp, err := R.getResponse(args.URI, pageVariant{}, false)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	if err := resp.decompress(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
 	c.Status(http.StatusOK)
 
 	c.Writer.Header()["Content-Type"] = []string{"application/json; charset=utf-8"}
@@ -48,3 +57,233 @@ func (R *Rendora) apiRender(c *gin.Context) {
 		panic(err)
 	}
 }
+
+type apiCachePurgeArgs struct {
+	URI    string `json:"uri"`
+	Prefix string `json:"prefix"`
+	Tag    string `json:"tag"`
+	All    bool   `json:"all"`
+}
+
+//apiCacheKey describes a cached page
+type apiCacheKey struct {
+	URI    string   `json:"uri"`
+	Age    float64  `json:"age"`
+	Size   int      `json:"size"`
+	Status int      `json:"status"`
+	Stale  bool     `json:"stale"`
+	Tags   []string `json:"tags,omitempty"`
+}
+
+// apiCachePurge removes cached pages by exact uri, by uri prefix, by tag or all of them
+func (R *Rendora) apiCachePurge(c *gin.Context) {
+
+	var args apiCachePurgeArgs
+	if err := c.ShouldBindJSON(&args); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var purged int
+	var err error
+	switch {
+	case args.URI != "":
+		if R.hasCacheKeyVariants() {
+			// purge the cached pages of all hosts and device classes
+			prefix := R.cacheKeyPrefix() + R.normalizeURI(args.URI) + cacheKeyVariantSeparator
+			purged, err = R.cache.deletePrefix(prefix)
+			break
+		}
+		normalized := R.cacheKey(args.URI, pageVariant{})
+		var exists bool
+		_, exists, err = R.cache.lookup(normalized)
+		if err == nil && exists {
+			err = R.cache.delete(normalized)
+			purged = 1
+		}
+	case args.Prefix != "":
+		purged, err = R.cache.deletePrefix(R.cacheKeyPrefix() + args.Prefix)
+	case args.Tag != "":
+		purged, err = R.cache.purgeTag(args.Tag)
+	case args.All:
+		purged, err = R.cache.deletePrefix(R.cacheKeyPrefix())
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "one of uri, prefix, tag or all is required"})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"purged": purged})
+}
+
+// apiCacheKeys lists the cached pages whose uri starts with the prefix query parameter
+func (R *Rendora) apiCacheKeys(c *gin.Context) {
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "1000"))
+	if err != nil || limit < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+		return
+	}
+
+	keyPrefix := R.cacheKeyPrefix()
+	cKeys, err := R.cache.scanKeys(keyPrefix + c.Query("prefix"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	keys := []*apiCacheKey{}
+	for _, cKey := range cKeys {
+		if len(keys) == limit {
+			break
+		}
+
+		entry, exists, err := R.cache.lookup(cKey)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !exists {
+			continue
+		}
+
+		keys = append(keys, &apiCacheKey{
+			URI:    strings.TrimPrefix(cKey, keyPrefix),
+			Age:    time.Since(entry.CreatedAt).Seconds(),
+			Size:   entry.storedSize(),
+			Status: entry.Response.Status,
+			Stale:  entry.isStale(),
+			Tags:   entry.Tags,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"keys":  keys,
+		"total": len(cKeys),
+	})
+}
+
+// apiCacheExport streams a cache archive of the cached pages whose uri starts with the prefix query parameter
+func (R *Rendora) apiCacheExport(c *gin.Context) {
+	R.liftDeadlines(c)
+	c.Header("Content-Disposition", `attachment; filename="rendora-cache.jsonl.gz"`)
+	c.Status(http.StatusOK)
+	c.Writer.Header()["Content-Type"] = []string{"application/gzip"}
+
+	// the status is already sent, the archive is left truncated on errors so that clients can detect them
+	exported, err := R.cache.exportArchive(c.Writer, c.Query("prefix"))
+	if err != nil {
+		log.Printf("Exporting the cache failed after %d pages: %v\n", exported, err)
+		return
+	}
+	log.Printf("Exported %d cached pages\n", exported)
+}
+
+// apiCacheImport stores the cached pages of the cache archive in the request body
+func (R *Rendora) apiCacheImport(c *gin.Context) {
+	R.liftDeadlines(c)
+	imported, skipped, err := R.cache.importArchive(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":    err.Error(),
+			"imported": imported,
+			"skipped":  skipped,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"imported": imported,
+		"skipped":  skipped,
+	})
+}
+
+type apiCacheVersionArgs struct {
+	Version string `json:"version"`
+}
+
+// apiCacheVersion provides the current cache version
+func (R *Rendora) apiCacheVersion(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"version": R.getCacheVersion()})
+}
+
+// apiCacheVersionSet changes the cache version so that all the previously cached pages are rendered again,
+// a new unique version is generated if none is provided
+func (R *Rendora) apiCacheVersionSet(c *gin.Context) {
+
+	var args apiCacheVersionArgs
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&args); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if args.Version == "" {
+		args.Version = strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+
+	previous := R.getCacheVersion()
+	if err := R.setCacheVersion(args.Version); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"version":  args.Version,
+		"previous": previous,
+	})
+}
+
+type apiWarmupArgs struct {
+	Sitemap string `json:"sitemap,omitempty"`
+	// URIs are warmed up instead of the pages of the sitemap, e.g. when rendora warm reads a local sitemap
+	URIs []string `json:"uris,omitempty"`
+}
+
+// apiWarmupStart starts rendering all the pages listed in the sitemap
+func (R *Rendora) apiWarmupStart(c *gin.Context) {
+
+	var args apiWarmupArgs
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&args); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if args.Sitemap != "" && len(args.URIs) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "either sitemap or uris can be set"})
+		return
+	}
+	if args.Sitemap != "" {
+		if err := R.checkWarmupSitemap(args.Sitemap); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := checkWarmupURIs(args.URIs); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := R.startWarmup(args.Sitemap, args.URIs)
+	if err == errWarmupRunning {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, R.getWarmupStatus())
+}
+
+// apiWarmupStatus provides the progress of the current (or last) warmup
+func (R *Rendora) apiWarmupStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, R.getWarmupStatus())
+}
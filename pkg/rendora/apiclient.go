@@ -0,0 +1,94 @@
+/*
+Copyright 2018 George Badawi.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rendora
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+//apiClient sends requests to the API server of a running Rendora instance (e.g. for rendora warm)
+type apiClient struct {
+	serverURL string
+	c         *rendoraConfig
+}
+
+//newAPIClient loads the config file, the API server url is derived from server.listen unless serverURL is set
+func newAPIClient(cfgFile, serverURL string) (*apiClient, error) {
+	R := &Rendora{
+		c:       &rendoraConfig{},
+		cfgFile: cfgFile,
+	}
+	if err := R.loadConfig(); err != nil {
+		return nil, err
+	}
+
+	if serverURL == "" {
+		address := R.c.Server.Listen.Address
+		if address == "0.0.0.0" {
+			address = "127.0.0.1"
+		}
+		serverURL = fmt.Sprintf("http://%s:%d", address, R.c.Server.Listen.Port)
+	}
+
+	return &apiClient{
+		serverURL: serverURL,
+		c:         R.c,
+	}, nil
+}
+
+//do sends the request to the endpoint, the response body must be closed by the caller if there isn't an error
+func (a *apiClient) do(method, endpoint, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, a.serverURL+endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if a.c.Server.Auth.Enable {
+		req.Header.Set(a.c.Server.Auth.Name, a.c.Server.Auth.Value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound && !a.c.Server.Auth.Enable {
+			return nil, fmt.Errorf("%s %s isn't available since server.auth isn't enabled", method, endpoint)
+		}
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return nil, fmt.Errorf("unsuccessful result with code: %d %s", resp.StatusCode, apiErr.Error)
+	}
+
+	return resp, nil
+}
+
+//doJSON sends the request to the endpoint and decodes the JSON response into ret
+func (a *apiClient) doJSON(method, endpoint string, body io.Reader, ret interface{}) error {
+	resp, err := a.do(method, endpoint, "application/json", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(ret)
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2018 George Badawi.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rendora
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+//botPresets maps each preset name to the lowercase keywords of the crawler user agents it matches, the presets are
+//shipped with Rendora so that upgrading it picks up new crawler signatures
+var botPresets = map[string][]string{
+	"search-engines": {
+		"googlebot",
+		"google-inspectiontool",
+		"googleother",
+		"storebot-google",
+		"adsbot-google",
+		"mediapartners-google",
+		"bingbot",
+		"bingpreview",
+		"adidxbot",
+		"msnbot",
+		"slurp",
+		"duckduckbot",
+		"baiduspider",
+		"yandexbot",
+		"yandex.com/bots",
+		"sogou",
+		"seznambot",
+		"naverbot",
+		"yeti/",
+		"applebot",
+		"petalbot",
+		"qwantify",
+		"mojeekbot",
+		"coccocbot",
+		"360spider",
+		"daum",
+		"exabot",
+	},
+	"social-previews": {
+		"facebookexternalhit",
+		"facebookcatalog",
+		"twitterbot",
+		"linkedinbot",
+		"slackbot",
+		"slack-imgproxy",
+		"discordbot",
+		"telegrambot",
+		"pinterestbot",
+		"pinterest/",
+		"redditbot",
+		"embedly",
+		"iframely",
+		"skypeuripreview",
+		"vkshare",
+		"quora link preview",
+		"bitlybot",
+		"snap url preview service",
+		"mastodon",
+		"cardyb",
+		"outbrain",
+	},
+	"seo-tools": {
+		"ahrefsbot",
+		"ahrefssiteaudit",
+		"semrushbot",
+		"siteauditbot",
+		"mj12bot",
+		"dotbot",
+		"rogerbot",
+		"screaming frog",
+		"seokicks",
+		"serpstatbot",
+		"blexbot",
+		"dataforseobot",
+		"sitebulb",
+		"oncrawl",
+		"deepcrawl",
+		"botify",
+		"barkrowler",
+		"linkdexbot",
+	},
+}
+
+//allBotsKeywords are the generic keywords matched by the all-bots preset in addition to all the other presets
+var allBotsKeywords = []string{
+	"crawler",
+	"crawling",
+	"spider",
+	"preview",
+}
+
+//botPresetPatterns maps the preset names to the patterns of the crawler user agents which can't be told apart from the
+//in-app browsers of the same apps by keywords
+var botPresetPatterns = map[string]patternList{
+	// the link previews of WhatsApp are fetched with "WhatsApp/2.23.20.0 A" while its in-app browser starts with "Mozilla/"
+	"social-previews": {
+		regexp.MustCompile(`(?i)^whatsapp/`),
+	},
+}
+
+//allBotsPatterns are the generic keywords matched by the all-bots preset as words rather than substrings (e.g. "bot"
+//matches "SomeBot/1.0" but not the "Cubot" phones)
+var allBotsPatterns = patternList{
+	regexp.MustCompile(`(?i)\bbot\b|bot/`),
+}
+
+//presetKeywords returns the keywords and patterns of the presets without duplicates, name is the config key reported
+//in errors
+func presetKeywords(name string, presets []string) ([]string, patternList, error) {
+	var keywords []string
+	var patterns patternList
+	seen := make(map[string]bool)
+	add := func(presetKeywords []string, presetPatterns patternList) {
+		for _, keyword := range presetKeywords {
+			if !seen[keyword] {
+				seen[keyword] = true
+				keywords = append(keywords, keyword)
+			}
+		}
+		for _, re := range presetPatterns {
+			if !seen[re.String()] {
+				seen[re.String()] = true
+				patterns = append(patterns, re)
+			}
+		}
+	}
+
+	for _, preset := range presets {
+		if preset == "all-bots" {
+			names := make([]string, 0, len(botPresets))
+			for name := range botPresets {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				add(botPresets[name], botPresetPatterns[name])
+			}
+			add(allBotsKeywords, allBotsPatterns)
+			continue
+		}
+
+		presetKeywords, ok := botPresets[preset]
+		if !ok {
+			return nil, nil, fmt.Errorf("%s: unknown preset %q", name, preset)
+		}
+		add(presetKeywords, botPresetPatterns[preset])
+	}
+
+	return keywords, patterns, nil
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2018 George Badawi.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rendora
+
+import "testing"
+
+func TestBotPresets(t *testing.T) {
+	tests := []struct {
+		name      string
+		presets   []string
+		userAgent string
+		want      bool
+	}{
+		{"Facebook", []string{"social-previews"}, "facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)", true},
+		{"WhatsApp preview", []string{"social-previews"}, "WhatsApp/2.23.20.0 A", true},
+		{"WhatsApp in-app browser", []string{"social-previews"}, "Mozilla/5.0 (Linux; Android 13; SM-S911B) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/116.0.0.0 Mobile Safari/537.36 WhatsApp/2.23.20.0", false},
+		{"Snapchat preview", []string{"social-previews"}, "Mozilla/5.0 (compatible; Snap URL Preview Service; bot; snapchat; https://developers.snap.com/robots)", true},
+		{"Snapchat in-app browser", []string{"social-previews"}, "Mozilla/5.0 (iPhone; CPU iPhone OS 16_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148 Snapchat/12.50.0.35 (like Safari/8614.1.25.0.31, panda)", false},
+		{"Viber in-app browser", []string{"social-previews"}, "Mozilla/5.0 (Linux; Android 12; Pixel 6) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/116.0.0.0 Mobile Safari/537.36 Viber/20.4.0.2", false},
+		{"Tumblr in-app browser", []string{"social-previews"}, "Mozilla/5.0 (iPhone; CPU iPhone OS 16_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148 Tumblr/iPhone/33.3", false},
+		{"WhatsApp preview in all-bots", []string{"all-bots"}, "WhatsApp/2.23.20.0 A", true},
+		{"generic bot in all-bots", []string{"all-bots"}, "Mozilla/5.0 (compatible; SomeBot/1.0)", true},
+		{"Cubot phone in all-bots", []string{"all-bots"}, "Mozilla/5.0 (Linux; Android 9; CUBOT P30) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/80.0.3987.99 Mobile Safari/537.36", false},
+		{"WhatsApp preview in search-engines", []string{"search-engines"}, "WhatsApp/2.23.20.0 A", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := compileUserAgentMatcher("presets", &filterUserAgentConfig{Presets: tt.presets})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.matches(tt.userAgent); got != tt.want {
+				t.Errorf("matches(%q) = %v, want %v", tt.userAgent, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBotPresetsUnknown(t *testing.T) {
+	if _, _, err := presetKeywords("presets", []string{"social-previews", "crawlers"}); err == nil {
+		t.Error("presetKeywords() succeeded with an unknown preset")
+	}
+}
@@ -15,109 +15,356 @@ package rendora
 
 import (
 	"bytes"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis"
-
-	cache "github.com/patrickmn/go-cache"
 )
 
+//CacheStore is implemented by the cache backends storing the rendered pages
+type CacheStore interface {
+	//Get gets the entry with the key cKey, it returns false if the entry doesn't exist or has expired
+	Get(cKey string) (*CacheEntry, bool, error)
+	//Set stores the entry with the key cKey, the entry is removed after ttl
+	Set(cKey string, entry *CacheEntry, ttl time.Duration) error
+	//Delete removes the entry with the key cKey
+	Delete(cKey string) error
+	//Scan returns the keys of all the entries starting with prefix
+	Scan(prefix string) ([]string, error)
+}
+
+//CacheEntry is the HeadlessResponse stored in the cache along with its metadata, if Gzip is set it holds the
+//gzip-compressed content and Response.Content is empty
+type CacheEntry struct {
+	Response  *HeadlessResponse `json:"response"`
+	Gzip      []byte            `json:"gzip,omitempty"`
+	Tags      []string          `json:"tags,omitempty"`
+	CreatedAt time.Time         `json:"createdAt"`
+	ExpiresAt time.Time         `json:"expiresAt"`
+}
+
+//storedSize returns the size of the stored content
+func (e *CacheEntry) storedSize() int {
+	if e.Gzip != nil {
+		return len(e.Gzip)
+	}
+	return len(e.Response.Content)
+}
+
+//isStale checks whether the entry has passed its soft TTL (i.e. it can only be served while being revalidated or if rendering fails)
+func (e *CacheEntry) isStale() bool {
+	return time.Now().After(e.ExpiresAt)
+}
+
+func encodeCacheEntry(entry *CacheEntry) ([]byte, error) {
+	op := &bytes.Buffer{}
+	enc := json.NewEncoder(op)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(entry)
+	if err != nil {
+		return nil, err
+	}
+	return op.Bytes(), nil
+}
+
+//decodeCacheEntry decodes the entry, it returns false for entries stored by older Rendora versions
+func decodeCacheEntry(data []byte) (*CacheEntry, bool, error) {
+	var entry CacheEntry
+	err := json.Unmarshal(data, &entry)
+	if err != nil || entry.Response == nil {
+		return nil, false, err
+	}
+	return &entry, true, nil
+}
+
 //cacheStore represents the cache store
 type cacheStore struct {
 	DefaultTimeout time.Duration
-	Type           uint8
-	redis          *redis.Client
-	gocache        *cache.Cache
+	StaleTimeout   time.Duration
+	store          CacheStore
+	local          *localStore // nil unless the cache type is local or tiered
 	rendora        *Rendora
 }
 
-const (
-	typeLocal = 0
-	typeRedis = 1
-	typeNone  = 2
-)
-
 //InitCacheStore initializes the cache store
-func (R *Rendora) initCacheStore() {
+func (R *Rendora) initCacheStore() error {
 	cs := &cacheStore{
 		DefaultTimeout: time.Duration(R.c.Cache.Timeout) * time.Second,
+		StaleTimeout:   time.Duration(R.c.Cache.StaleTimeout) * time.Second,
 		rendora:        R,
 	}
 
 	switch R.c.Cache.Type {
-	case "local":
-		cs.Type = typeLocal
-		cs.gocache = cache.New(cs.DefaultTimeout, 4*time.Minute)
 	case "redis":
-		cs.Type = typeRedis
-		cs.redis = redis.NewClient(&redis.Options{
-			Addr:     R.c.Cache.Redis.Address,
-			Password: R.c.Cache.Redis.Password,
-			DB:       R.c.Cache.Redis.DB,
-		})
+		client, err := R.newRedisClient()
+		if err != nil {
+			return err
+		}
+		cs.store = &redisStore{
+			client: client,
+		}
+	case "tiered":
+		channel := R.c.Cache.Tiered.Channel
+		if channel == "" {
+			channel = R.c.Cache.KeyPrefix + ":invalidate"
+		}
+		client, err := R.newRedisClient()
+		if err != nil {
+			return err
+		}
+		cs.local = newLocalStore(int64(R.c.Cache.Local.MaxBytes), int(R.c.Cache.Tiered.LocalMaxEntries))
+		ts, err := newTieredStore(
+			cs.local,
+			&redisStore{
+				client: client,
+			},
+			time.Duration(R.c.Cache.Tiered.LocalTimeout)*time.Second,
+			channel,
+			R.syncCacheVersion)
+		if err != nil {
+			return err
+		}
+		cs.store = ts
+	case "disk":
+		ds, err := newDiskStore(R.c.Cache.Disk.Path)
+		if err != nil {
+			return err
+		}
+		cs.store = ds
 	case "none":
-		cs.Type = typeNone
+		cs.store = noneStore{}
 	default:
-		cs.Type = typeLocal
+		cs.local = newLocalStore(int64(R.c.Cache.Local.MaxBytes), int(R.c.Cache.Local.MaxEntries))
+		cs.store = cs.local
 	}
 
 	R.cache = cs
+	return nil
 }
 
-//Set stores HeadlessResponse in the cache with the key cKey (i.e. request path)
-func (c *cacheStore) set(cKey string, d *HeadlessResponse) error {
+//hardTimeout is the duration after which entries are removed from the cache store
+func (c *cacheStore) hardTimeout() time.Duration {
+	return c.DefaultTimeout + c.StaleTimeout
+}
 
-	switch c.Type {
-	case typeLocal:
-		c.gocache.Set(cKey, d, cache.DefaultExpiration)
-	case typeRedis:
-		op := &bytes.Buffer{}
-		enc := json.NewEncoder(op)
-		enc.SetEscapeHTML(false)
-		err := enc.Encode(d)
-		if err != nil {
-			return err
+//Set stores HeadlessResponse in the cache with the key cKey (i.e. request path) along with its tags, it stays fresh for timeout
+func (c *cacheStore) set(cKey string, d *HeadlessResponse, timeout time.Duration, tags []string) error {
+	now := time.Now()
+	entry := &CacheEntry{
+		Response:  d,
+		Tags:      tags,
+		CreatedAt: now,
+		ExpiresAt: now.Add(timeout),
+	}
+
+	if d.gzipped != nil {
+		stored := *d
+		stored.Content = ""
+		stored.gzipped = nil
+		entry.Response = &stored
+		entry.Gzip = d.gzipped
+	}
+
+	if err := c.store.Set(cKey, entry, timeout+c.StaleTimeout); err != nil {
+		return err
+	}
+	return c.tag(cKey, tags, timeout+c.StaleTimeout)
+}
+
+//Get gets the cached HeadlessResponse along with its metadata from the cache with the key cKey (i.e. request path)
+func (c *cacheStore) get(cKey string) (*CacheEntry, bool, error) {
+	entry, exists, err := c.lookup(cKey)
+	if exists && c.rendora.c.Server.Enable {
+		c.rendora.metrics.CountSSRCached.Inc()
+	}
+	return entry, exists, err
+}
+
+//lookup gets the cache entry with the key cKey without counting it as a cached SSR request
+func (c *cacheStore) lookup(cKey string) (*CacheEntry, bool, error) {
+	entry, exists, err := c.store.Get(cKey)
+	if !exists || entry.Gzip == nil {
+		return entry, exists, err
+	}
+
+	// entries may be shared (e.g. by the local store), the compressed content is attached to a copy of the response
+	resp := *entry.Response
+	resp.gzipped = entry.Gzip
+	ret := *entry
+	ret.Response = &resp
+	return &ret, true, nil
+}
+
+//delete removes the entry with the key cKey from the cache
+func (c *cacheStore) delete(cKey string) error {
+	return c.store.Delete(cKey)
+}
+
+//deletePrefix removes all the entries whose keys start with prefix and returns their count
+func (c *cacheStore) deletePrefix(prefix string) (int, error) {
+	keys, err := c.scanKeys(prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, cKey := range keys {
+		if err := c.delete(cKey); err != nil {
+			return 0, err
 		}
-		err = c.redis.SetNX(cKey, string(op.Bytes()), c.DefaultTimeout).Err()
+	}
+	return len(keys), nil
+}
+
+//scanKeys returns the sorted keys of all the entries starting with prefix
+func (c *cacheStore) scanKeys(prefix string) ([]string, error) {
+	ret, err := c.store.Scan(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(ret)
+	return ret, nil
+}
+
+//redisStore stores the cache entries JSON-encoded in Redis
+type redisStore struct {
+	client redis.UniversalClient
+}
+
+func (s *redisStore) Get(cKey string) (*CacheEntry, bool, error) {
+	val, err := s.client.Get(cKey).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return decodeCacheEntry(val)
+}
+
+func (s *redisStore) Set(cKey string, entry *CacheEntry, ttl time.Duration) error {
+	data, err := encodeCacheEntry(entry)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(cKey, data, ttl).Err()
+}
+
+func (s *redisStore) Delete(cKey string) error {
+	return s.client.Del(cKey).Err()
+}
+
+func (s *redisStore) GetVersion(key string) ([]byte, bool, error) {
+	val, err := s.client.Get(key).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return val, true, nil
+}
+
+func (s *redisStore) SetVersion(key string, state []byte) error {
+	return s.client.Set(key, state, 0).Err()
+}
+
+func (s *redisStore) Scan(prefix string) ([]string, error) {
+	match := redisGlobEscaper.Replace(prefix) + "*"
+
+	cluster, ok := s.client.(*redis.ClusterClient)
+	if !ok {
+		return redisScan(s.client, match)
+	}
+
+	// the keys are spread over the cluster masters
+	var ret []string
+	mtx := &sync.Mutex{}
+	err := cluster.ForEachMaster(func(client *redis.Client) error {
+		keys, err := redisScan(client, match)
 		if err != nil {
 			return err
 		}
-	case typeNone:
-	default:
+		mtx.Lock()
+		ret = append(ret, keys...)
+		mtx.Unlock()
+		return nil
+	})
+	return ret, err
+}
+
+func (s *redisStore) Tag(cKey string, tagKeys []string, ttl time.Duration) error {
+	pipe := s.client.Pipeline()
+	pttls := make([]*redis.DurationCmd, len(tagKeys))
+	for i, tagKey := range tagKeys {
+		pipe.SAdd(tagKey, cKey)
+		pttls[i] = pipe.PTTL(tagKey)
 	}
-	return nil
+	if _, err := pipe.Exec(); err != nil {
+		return err
+	}
+
+	// the index must outlive all of its keys
+	pipe = s.client.Pipeline()
+	for i, tagKey := range tagKeys {
+		if pttls[i].Val() < ttl {
+			pipe.PExpire(tagKey, ttl)
+		}
+	}
+	_, err := pipe.Exec()
+	return err
+}
+
+func (s *redisStore) TaggedKeys(tagKey string) ([]string, error) {
+	return s.client.SMembers(tagKey).Result()
 }
 
-//Get gets HeadlessResponse from the cache with the key cKey (i.e. request path)
-func (c *cacheStore) get(cKey string) (*HeadlessResponse, bool, error) {
+func (s *redisStore) Untag(tagKey string, cKeys []string) error {
+	if len(cKeys) == 0 {
+		return nil
+	}
+	members := make([]interface{}, len(cKeys))
+	for i, cKey := range cKeys {
+		members[i] = cKey
+	}
+	return s.client.SRem(tagKey, members...).Err()
+}
 
-	switch c.Type {
-	case typeLocal:
-		if x, found := c.gocache.Get(cKey); found {
-			foo := x.(*HeadlessResponse)
-			if c.rendora.c.Server.Enable {
-				c.rendora.metrics.CountSSRCached.Inc()
-			}
-			return foo, true, nil
+//redisScan returns the keys matching the pattern match on a single Redis server
+func redisScan(client redis.Cmdable, match string) ([]string, error) {
+	var ret []string
+	var cursor uint64
+	for {
+		keys, next, err := client.Scan(cursor, match, 1000).Result()
+		if err != nil {
+			return nil, err
 		}
-		return nil, false, nil
-	case typeRedis:
-		val, err := c.redis.Get(cKey).Result()
-		if err == redis.Nil {
-			return nil, false, nil
-		} else if err != nil {
-			return nil, false, err
-		} else {
-			var dt HeadlessResponse
-			json.Unmarshal([]byte(val), &dt)
-			if c.rendora.c.Server.Enable {
-				c.rendora.metrics.CountSSRCached.Inc()
-			}
-			return &dt, true, nil
+		ret = append(ret, keys...)
+		if next == 0 {
+			break
 		}
-	case typeNone:
-		return nil, false, nil
-	default:
-		return nil, false, nil
+		cursor = next
 	}
+	return ret, nil
+}
+
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+//noneStore disables caching
+type noneStore struct{}
+
+func (noneStore) Get(cKey string) (*CacheEntry, bool, error) {
+	return nil, false, nil
+}
+
+func (noneStore) Set(cKey string, entry *CacheEntry, ttl time.Duration) error {
+	return nil
+}
+
+func (noneStore) Delete(cKey string) error {
+	return nil
+}
+
+func (noneStore) Scan(prefix string) ([]string, error) {
+	return nil, nil
 }
@@ -0,0 +1,212 @@
+/*
+Copyright 2018 George Badawi.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rendora
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	cacheArchiveFormat  = "rendora-cache"
+	cacheArchiveVersion = 1
+	//cacheArchiveMaxLine limits the size of a single archived entry
+	cacheArchiveMaxLine = 64 << 20
+)
+
+//cacheArchiveHeader is the first line of cache archives, cache archives are gzip-compressed JSON lines so that they
+//can be written and read entry by entry
+type cacheArchiveHeader struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+//cacheArchiveRecord is an archived entry, the key doesn't include the cache key prefix so that entries can be
+//imported by instances using other prefixes or cache versions
+type cacheArchiveRecord struct {
+	Key   string      `json:"key"`
+	Entry *CacheEntry `json:"entry"`
+}
+
+//exportArchive writes all the entries whose uris start with prefix to w and returns their count
+func (c *cacheStore) exportArchive(w io.Writer, prefix string) (int, error) {
+	keyPrefix := c.rendora.cacheKeyPrefix()
+	cKeys, err := c.scanKeys(keyPrefix + prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+	enc.SetEscapeHTML(false)
+
+	err = enc.Encode(&cacheArchiveHeader{
+		Format:    cacheArchiveFormat,
+		Version:   cacheArchiveVersion,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	exported := 0
+	for _, cKey := range cKeys {
+		// the entries are archived as stored (i.e. compressed if they are)
+		entry, exists, err := c.store.Get(cKey)
+		if err != nil {
+			return exported, err
+		}
+		if !exists {
+			continue
+		}
+
+		err = enc.Encode(&cacheArchiveRecord{
+			Key:   cKey[len(keyPrefix):],
+			Entry: entry,
+		})
+		if err != nil {
+			return exported, err
+		}
+		exported++
+	}
+
+	return exported, gz.Close()
+}
+
+//importArchive stores the entries read from r and returns the count of imported and skipped (i.e. expired) entries
+func (c *cacheStore) importArchive(r io.Reader) (int, int, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid cache archive: %v", err)
+	}
+	defer gz.Close()
+
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(nil, cacheArchiveMaxLine)
+
+	if !scanner.Scan() {
+		if err = scanner.Err(); err != nil {
+			return 0, 0, err
+		}
+		return 0, 0, errors.New("invalid cache archive: it is empty")
+	}
+
+	var header cacheArchiveHeader
+	if err = json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Format != cacheArchiveFormat {
+		return 0, 0, errors.New("invalid cache archive: unknown format")
+	}
+	if header.Version != cacheArchiveVersion {
+		return 0, 0, fmt.Errorf("unsupported cache archive version: %d", header.Version)
+	}
+
+	keyPrefix := c.rendora.cacheKeyPrefix()
+	imported, skipped := 0, 0
+	for scanner.Scan() {
+		var record cacheArchiveRecord
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return imported, skipped, fmt.Errorf("invalid cache archive entry: %v", err)
+		}
+		if record.Key == "" || record.Entry == nil || record.Entry.Response == nil {
+			return imported, skipped, errors.New("invalid cache archive entry: missing key or response")
+		}
+
+		ttl := time.Until(record.Entry.ExpiresAt) + c.StaleTimeout
+		if ttl <= 0 {
+			skipped++
+			continue
+		}
+
+		cKey := keyPrefix + record.Key
+		if err = c.store.Set(cKey, record.Entry, ttl); err != nil {
+			return imported, skipped, err
+		}
+		if err = c.tag(cKey, record.Entry.Tags, ttl); err != nil {
+			return imported, skipped, err
+		}
+		imported++
+	}
+
+	return imported, skipped, scanner.Err()
+}
+
+//ExportCache writes all the cached pages of the running Rendora instance whose uris start with prefix to w
+//through its API server
+func ExportCache(cfgFile, serverURL, prefix string, w io.Writer) error {
+	client, err := newAPIClient(cfgFile, serverURL)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.do(http.MethodGet, "/cache/export?prefix="+url.QueryEscape(prefix), "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// the archive is validated while being copied since the server can't report errors once it is streamed
+	gz, err := gzip.NewReader(io.TeeReader(resp.Body, w))
+	if err != nil {
+		return fmt.Errorf("invalid cache archive: %v", err)
+	}
+	defer gz.Close()
+
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(nil, cacheArchiveMaxLine)
+	lines := 0
+	for scanner.Scan() {
+		lines++
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("the cache archive is incomplete: %v", err)
+	}
+	if lines == 0 {
+		return errors.New("invalid cache archive: it is empty")
+	}
+
+	// the first line is the archive header
+	log.Printf("Exported %d cached pages\n", lines-1)
+	return nil
+}
+
+//ImportCache stores the cached pages read from r in the running Rendora instance through its API server
+func ImportCache(cfgFile, serverURL string, r io.Reader) error {
+	client, err := newAPIClient(cfgFile, serverURL)
+	if err != nil {
+		return err
+	}
+
+	var ret struct {
+		Imported int `json:"imported"`
+		Skipped  int `json:"skipped"`
+	}
+	resp, err := client.do(http.MethodPost, "/cache/import", "application/gzip", r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err = json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return err
+	}
+
+	log.Printf("Imported %d cached pages, skipped %d expired ones\n", ret.Imported, ret.Skipped)
+	return nil
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2018 George Badawi.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rendora
+
+import (
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+//newTestArchiveCache returns a local cache store using the key prefix and cache version
+func newTestArchiveCache(keyPrefix, version string) *cacheStore {
+	R := &Rendora{c: &rendoraConfig{}}
+	R.c.Cache.KeyPrefix = keyPrefix
+	R.cacheVersion.Store(version)
+	R.cache = &cacheStore{
+		DefaultTimeout: time.Minute,
+		store:          newLocalStore(0, 0),
+		rendora:        R,
+	}
+	return R.cache
+}
+
+//testArchive returns the gzip-compressed lines
+func testArchive(lines ...string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(strings.Join(lines, "\n")))
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestCacheArchiveRoundTrip(t *testing.T) {
+	now := time.Now().Round(time.Second)
+	entries := map[string]*CacheEntry{
+		"/": {
+			Response:  &HeadlessResponse{Status: 200, Content: "<html>home</html>", Headers: map[string]string{"Content-Type": "text/html"}},
+			CreatedAt: now,
+			ExpiresAt: now.Add(time.Minute),
+		},
+		"/blog/post": {
+			Response:  &HeadlessResponse{Status: 200},
+			Gzip:      testArchive("<html>post</html>"),
+			Tags:      []string{"blog", "post"},
+			CreatedAt: now,
+			ExpiresAt: now.Add(time.Hour),
+		},
+		"/blog/old": {
+			Response:  &HeadlessResponse{Status: 200, Content: "<html>old</html>"},
+			CreatedAt: now.Add(-time.Hour),
+			ExpiresAt: now.Add(-time.Minute),
+		},
+	}
+
+	tests := []struct {
+		name     string
+		prefix   string
+		exported int
+		imported []string
+		skipped  int
+		tagged   []string
+	}{
+		{"all pages", "", 3, []string{"/", "/blog/post"}, 1, []string{"/blog/post"}},
+		{"prefix", "/blog", 2, []string{"/blog/post"}, 1, []string{"/blog/post"}},
+		{"no pages", "/about", 0, nil, 0, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := newTestArchiveCache("src", "v1")
+			for uri, entry := range entries {
+				// the store keeps expired entries as long as they can be served stale
+				if err := src.store.Set(src.rendora.cacheKeyPrefix()+uri, entry, 2*time.Hour); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// entries of other cache versions aren't exported
+			src.store.Set("src:v0:/", entries["/"], time.Hour)
+
+			var archive bytes.Buffer
+			exported, err := src.exportArchive(&archive, tt.prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exported != tt.exported {
+				t.Errorf("exportArchive() = %d, want %d", exported, tt.exported)
+			}
+
+			// archives can be imported by instances using other key prefixes and cache versions
+			dst := newTestArchiveCache("dst", "v2")
+			imported, skipped, err := dst.importArchive(&archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if imported != len(tt.imported) || skipped != tt.skipped {
+				t.Errorf("importArchive() = %d, %d, want %d, %d", imported, skipped, len(tt.imported), tt.skipped)
+			}
+
+			keys, _ := dst.scanKeys("")
+			var wantKeys []string
+			for _, uri := range tt.imported {
+				wantKeys = append(wantKeys, "dst:v2:"+uri)
+			}
+			if !reflect.DeepEqual(keys, wantKeys) {
+				t.Errorf("imported keys = %v, want %v", keys, wantKeys)
+			}
+
+			for _, uri := range tt.imported {
+				got, _, _ := dst.store.Get("dst:v2:" + uri)
+				want := entries[uri]
+				if !reflect.DeepEqual(got.Response, want.Response) || !bytes.Equal(got.Gzip, want.Gzip) ||
+					!reflect.DeepEqual(got.Tags, want.Tags) || !got.ExpiresAt.Equal(want.ExpiresAt) {
+					t.Errorf("imported %s = %+v, want %+v", uri, got, want)
+				}
+			}
+
+			tagged, _ := dst.store.(CacheTagIndex).TaggedKeys(dst.rendora.cacheTagKey("blog"))
+			var wantTagged []string
+			for _, uri := range tt.tagged {
+				wantTagged = append(wantTagged, "dst:v2:"+uri)
+			}
+			if !reflect.DeepEqual(tagged, wantTagged) {
+				t.Errorf("tagged keys = %v, want %v", tagged, wantTagged)
+			}
+		})
+	}
+}
+
+func TestCacheArchiveImportInvalid(t *testing.T) {
+	const header = `{"format":"rendora-cache","version":1,"createdAt":"2018-11-01T00:00:00Z"}`
+
+	tests := []struct {
+		name    string
+		archive []byte
+	}{
+		{"not compressed", []byte(header)},
+		{"empty", testArchive()},
+		{"unknown format", testArchive(`{"format":"other","version":1}`)},
+		{"unsupported version", testArchive(`{"format":"rendora-cache","version":2}`)},
+		{"invalid entry", testArchive(header, `{"key":`)},
+		{"missing key", testArchive(header, `{"entry":{"response":{"status":200}}}`)},
+		{"missing response", testArchive(header, `{"key":"/","entry":{}}`)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := newTestArchiveCache("dst", "")
+			if _, _, err := dst.importArchive(bytes.NewReader(tt.archive)); err == nil {
+				t.Error("importArchive() succeeded, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,384 @@
+/*
+Copyright 2018 George Badawi.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rendora
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mssola/user_agent"
+)
+
+//cacheKeyVariantSeparator separates the normalized uri from the host and device class parts of the cache key,
+//it can't be part of the normalized uri since spaces are always escaped in valid uris
+const cacheKeyVariantSeparator = " "
+
+//validateCacheKeyConfig checks the ignored query parameter patterns and the hosts
+func (R *Rendora) validateCacheKeyConfig() error {
+	keyConfig := &R.c.Cache.Key
+	for _, pattern := range keyConfig.IgnoreParams {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("cache.key.ignoreParams: invalid pattern %q: %v", pattern, err)
+		}
+	}
+
+	if keyConfig.IncludeHost && len(keyConfig.Hosts) == 0 {
+		return errors.New("cache.key.hosts is required when cache.key.includeHost is set")
+	}
+	for i, host := range keyConfig.Hosts {
+		if host == "" || strings.ContainsAny(host, "/:?# ") {
+			return fmt.Errorf("cache.key.hosts: invalid host %q", host)
+		}
+		keyConfig.Hosts[i] = strings.ToLower(host)
+	}
+	return nil
+}
+
+//pageVariant is the host and device class a page is rendered and cached for, its zero value is the target website
+//rendered for desktops
+type pageVariant struct {
+	host   string
+	mobile bool
+}
+
+//requestVariant returns the variant of the page requested by r, the host and device class are only set if they are
+//included in the cache key
+func (R *Rendora) requestVariant(r *http.Request) pageVariant {
+	var ret pageVariant
+	keyConfig := &R.c.Cache.Key
+
+	// other hosts get the target website, otherwise anyone could make Rendora render any website
+	if host := strings.ToLower(requestHost(r)); keyConfig.IncludeHost && isInSlice(keyConfig.Hosts, host) {
+		ret.host = host
+	}
+	if keyConfig.IncludeDevice {
+		ret.mobile = user_agent.New(r.Header.Get("User-Agent")).Mobile()
+	}
+	return ret
+}
+
+//renderURL returns the url rendered for the request uri, hosts are rendered using the scheme of the target website
+func (R *Rendora) renderURL(uri string, variant pageVariant) string {
+	if variant.host == "" {
+		return R.c.Target.URL + uri
+	}
+
+	scheme := "http"
+	if targetURL, err := url.Parse(R.c.Target.URL); err == nil && targetURL.Scheme != "" {
+		scheme = targetURL.Scheme
+	}
+	return scheme + "://" + variant.host + uri
+}
+
+const (
+	defaultCacheKeyPrefix    = "__:::rendora:"
+	cacheVersionSyncInterval = 5 * time.Second
+)
+
+//CacheVersionStore is implemented by the cache stores shared by multiple Rendora instances or kept across restarts,
+//the cache version is kept in them so that all the instances use the same version and changes survive restarts
+type CacheVersionStore interface {
+	//GetVersion returns the stored cache version state
+	GetVersion(key string) ([]byte, bool, error)
+	//SetVersion stores the cache version state and notifies the other instances if possible
+	SetVersion(key string, state []byte) error
+}
+
+//cacheVersionState is the cache version as kept in the cache store, Configured is the version set in the config when
+//it was stored so that changing the config (e.g. on deploys) still takes effect while restarts keep changes made
+//through the API
+type cacheVersionState struct {
+	Version    string `json:"version"`
+	Configured string `json:"configured"`
+}
+
+//initCacheNamespace sets the initial cache version from the environment variable, the file or the config in that order
+func (R *Rendora) initCacheNamespace() error {
+	namespace := &R.c.Cache.Namespace
+	version := namespace.Version
+
+	if namespace.VersionFile != "" {
+		data, err := ioutil.ReadFile(namespace.VersionFile)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cache.namespace.versionFile: %v", err)
+		}
+		if v := strings.TrimSpace(string(data)); v != "" {
+			version = v
+		}
+	}
+
+	if namespace.VersionEnv != "" {
+		if v := strings.TrimSpace(os.Getenv(namespace.VersionEnv)); v != "" {
+			version = v
+		}
+	}
+
+	if err := validateCacheVersion(version); err != nil {
+		return err
+	}
+	R.configuredCacheVersion = version
+	R.useCacheVersion(version)
+	return nil
+}
+
+//initSharedCacheVersion loads the cache version kept in the cache store, the configured version is stored instead
+//if there isn't any or if the config has changed since it was stored
+func (R *Rendora) initSharedCacheVersion() error {
+	versions, ok := R.cache.store.(CacheVersionStore)
+	if !ok {
+		return nil
+	}
+
+	state, exists, err := R.loadCacheVersion(versions)
+	if err != nil {
+		return fmt.Errorf("loading the cache version failed: %v", err)
+	}
+
+	if !exists || state.Configured != R.configuredCacheVersion {
+		state = &cacheVersionState{
+			Version:    R.configuredCacheVersion,
+			Configured: R.configuredCacheVersion,
+		}
+		if err = R.storeCacheVersion(versions, state); err != nil {
+			return fmt.Errorf("storing the cache version failed: %v", err)
+		}
+	}
+	R.useCacheVersion(state.Version)
+
+	// stores that can notify the other instances still need polling since notifications can be lost while reconnecting
+	go func() {
+		for range time.Tick(cacheVersionSyncInterval) {
+			R.syncCacheVersion()
+		}
+	}()
+	return nil
+}
+
+//cacheVersionKey returns the key of the cache version state, it can't collide with the cache keys
+func (R *Rendora) cacheVersionKey() string {
+	return R.c.Cache.KeyPrefix + "#version"
+}
+
+func (R *Rendora) loadCacheVersion(versions CacheVersionStore) (*cacheVersionState, bool, error) {
+	data, exists, err := versions.GetVersion(R.cacheVersionKey())
+	if err != nil || !exists {
+		return nil, false, err
+	}
+
+	var state cacheVersionState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, false, err
+	}
+	if err = validateCacheVersion(state.Version); err != nil {
+		return nil, false, err
+	}
+	return &state, true, nil
+}
+
+func (R *Rendora) storeCacheVersion(versions CacheVersionStore, state *cacheVersionState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return versions.SetVersion(R.cacheVersionKey(), data)
+}
+
+//syncCacheVersion switches to the cache version changed by another instance
+func (R *Rendora) syncCacheVersion() {
+	cache := R.cache
+	if cache == nil {
+		return
+	}
+	versions, ok := cache.store.(CacheVersionStore)
+	if !ok {
+		return
+	}
+
+	state, exists, err := R.loadCacheVersion(versions)
+	if err != nil {
+		log.Println("Loading the cache version failed:", err)
+		return
+	}
+	if exists && state.Version != R.getCacheVersion() {
+		log.Println("Switching to the cache version", state.Version)
+		R.useCacheVersion(state.Version)
+	}
+}
+
+//validateCacheVersion checks that the version can be part of the cache keys
+func validateCacheVersion(version string) error {
+	if strings.ContainsAny(version, ": \t\r\n") {
+		return fmt.Errorf("invalid cache version %q: it can't contain colons or spaces", version)
+	}
+	return nil
+}
+
+//getCacheVersion returns the current cache version
+func (R *Rendora) getCacheVersion() string {
+	version, _ := R.cacheVersion.Load().(string)
+	return version
+}
+
+//setCacheVersion changes the cache version of all the instances sharing the cache store, the pages cached with other
+//versions are no longer used
+func (R *Rendora) setCacheVersion(version string) error {
+	if err := validateCacheVersion(version); err != nil {
+		return err
+	}
+
+	if versions, ok := R.cache.store.(CacheVersionStore); ok {
+		err := R.storeCacheVersion(versions, &cacheVersionState{
+			Version:    version,
+			Configured: R.configuredCacheVersion,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	R.useCacheVersion(version)
+	return nil
+}
+
+//useCacheVersion switches the current cache version, the pages tracked for refreshing belong to the previous version
+//so they are dropped
+func (R *Rendora) useCacheVersion(version string) {
+	if previous, ok := R.cacheVersion.Load().(string); ok && previous == version {
+		return
+	}
+	R.cacheVersion.Store(version)
+	R.resetRefresh()
+}
+
+//cacheKeyPrefix returns the prefix shared by all the cache keys of the current cache version
+func (R *Rendora) cacheKeyPrefix() string {
+	if version := R.getCacheVersion(); version != "" {
+		return R.c.Cache.KeyPrefix + ":" + version + ":"
+	}
+	return R.c.Cache.KeyPrefix + ":"
+}
+
+//cacheKey returns the cache key of the request uri, the host and device class of the variant are included if
+//configured
+func (R *Rendora) cacheKey(uri string, variant pageVariant) string {
+	cKey := R.cacheKeyPrefix() + R.normalizeURI(uri)
+
+	keyConfig := &R.c.Cache.Key
+	if keyConfig.IncludeHost {
+		host := variant.host
+		if host == "" {
+			if targetURL, err := url.Parse(R.c.Target.URL); err == nil {
+				host = strings.ToLower(targetURL.Hostname())
+			}
+		}
+		cKey += cacheKeyVariantSeparator + "host=" + host
+	}
+
+	if keyConfig.IncludeDevice {
+		device := "desktop"
+		if variant.mobile {
+			device = "mobile"
+		}
+		cKey += cacheKeyVariantSeparator + "device=" + device
+	}
+
+	return cKey
+}
+
+//hasCacheKeyVariants checks whether the same uri can be cached under multiple keys (i.e. per host or per device class)
+func (R *Rendora) hasCacheKeyVariants() bool {
+	return R.c.Cache.Key.IncludeHost || R.c.Cache.Key.IncludeDevice
+}
+
+//normalizeURI applies the cache key rules to the request uri so that equivalent uris share the same cache entry
+func (R *Rendora) normalizeURI(uri string) string {
+	keyConfig := &R.c.Cache.Key
+
+	rawURI, fragment := uri, ""
+	if i := strings.Index(uri, "#"); i >= 0 {
+		rawURI = uri[:i]
+		unescaped, err := url.PathUnescape(uri[i+1:])
+		if err != nil {
+			return uri
+		}
+		if !keyConfig.StripFragment && unescaped != "" {
+			fragment = "#" + url.PathEscape(unescaped)
+		}
+	}
+
+	// url.Parse would take the first segment of uris starting with "//" as a host, making "//a/b" share the key of "/b"
+	u, err := url.ParseRequestURI(rawURI)
+	if err != nil {
+		return uri
+	}
+
+	p := u.EscapedPath()
+	if keyConfig.LowercasePath {
+		p = strings.ToLower(p)
+	}
+	if keyConfig.StripTrailingSlash && len(p) > 1 {
+		p = strings.TrimRight(p, "/")
+		if p == "" {
+			p = "/"
+		}
+	}
+
+	if u.RawQuery == "" {
+		return p + fragment
+	}
+
+	var params []string
+	for _, param := range strings.Split(u.RawQuery, "&") {
+		if param == "" || R.isIgnoredParam(param) {
+			continue
+		}
+		params = append(params, param)
+	}
+
+	if keyConfig.SortParams {
+		sort.Strings(params)
+	}
+
+	if len(params) == 0 {
+		return p + fragment
+	}
+	return p + "?" + strings.Join(params, "&") + fragment
+}
+
+//isIgnoredParam checks whether the raw query parameter (i.e. name=value) matches any of the ignored parameters
+func (R *Rendora) isIgnoredParam(param string) bool {
+	name := param
+	if i := strings.Index(param, "="); i >= 0 {
+		name = param[:i]
+	}
+	if unescaped, err := url.QueryUnescape(name); err == nil {
+		name = unescaped
+	}
+
+	for _, pattern := range R.c.Cache.Key.IgnoreParams {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
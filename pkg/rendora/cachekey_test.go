@@ -0,0 +1,186 @@
+/*
+Copyright 2018 George Badawi.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rendora
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizeURI(t *testing.T) {
+	tests := []struct {
+		name               string
+		ignoreParams       []string
+		sortParams         bool
+		stripFragment      bool
+		stripTrailingSlash bool
+		lowercasePath      bool
+		uri                string
+		want               string
+	}{
+		{name: "as is", uri: "/Blog/post/?b=2&a=1#top", want: "/Blog/post/?b=2&a=1#top"},
+		{name: "sorted params", sortParams: true, uri: "/?b=2&a=1&c", want: "/?a=1&b=2&c"},
+		{name: "empty params", uri: "/?&a=1&&", want: "/?a=1"},
+		{name: "stripped fragment", stripFragment: true, uri: "/post#top", want: "/post"},
+		{name: "stripped trailing slash", stripTrailingSlash: true, uri: "/post//?a=1", want: "/post?a=1"},
+		{name: "root slash kept", stripTrailingSlash: true, uri: "/", want: "/"},
+		{name: "only slashes", stripTrailingSlash: true, uri: "//", want: "/"},
+		{name: "leading double slash", uri: "//evil.example/post", want: "//evil.example/post"},
+		{name: "escaped fragment", uri: "/post#a%20b", want: "/post#a%20b"},
+		{name: "empty fragment", uri: "/post?a=1#", want: "/post?a=1"},
+		{name: "lowercase path", lowercasePath: true, uri: "/Blog/Post?Q=A", want: "/blog/post?Q=A"},
+		{name: "ignored param", ignoreParams: []string{"fbclid"}, uri: "/?fbclid=x&a=1", want: "/?a=1"},
+		{name: "ignored param without value", ignoreParams: []string{"debug"}, uri: "/?debug&a=1", want: "/?a=1"},
+		{name: "all params ignored", ignoreParams: []string{"fbclid"}, uri: "/post?fbclid=x#top", want: "/post#top"},
+		{name: "prefix wildcard", ignoreParams: []string{"utm_*"}, uri: "/?utm_source=a&utm_medium=b&utmx=c", want: "/?utmx=c"},
+		{name: "single character wildcard", ignoreParams: []string{"v?"}, uri: "/?v1=a&v12=b&v=c", want: "/?v12=b&v=c"},
+		{name: "character class", ignoreParams: []string{"_[ab]"}, uri: "/?_a=1&_b=2&_c=3", want: "/?_c=3"},
+		{name: "escaped param name", ignoreParams: []string{"utm_*"}, uri: "/?utm%5Fsource=a&a=1", want: "/?a=1"},
+		{name: "wildcard not matching values", ignoreParams: []string{"*=x"}, uri: "/?a=x", want: "/?a=x"},
+		{name: "ignored and sorted", ignoreParams: []string{"gclid", "utm_*"}, sortParams: true, uri: "/?z=1&gclid=x&utm_term=y&a=2", want: "/?a=2&z=1"},
+		{name: "escaped path", uri: "/caf%C3%A9/a%20b", want: "/caf%C3%A9/a%20b"},
+		{name: "invalid uri", uri: "/%zz?a", want: "/%zz?a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			R := &Rendora{c: &rendoraConfig{}}
+			keyConfig := &R.c.Cache.Key
+			keyConfig.IgnoreParams = tt.ignoreParams
+			keyConfig.SortParams = tt.sortParams
+			keyConfig.StripFragment = tt.stripFragment
+			keyConfig.StripTrailingSlash = tt.stripTrailingSlash
+			keyConfig.LowercasePath = tt.lowercasePath
+			if err := R.validateCacheKeyConfig(); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := R.normalizeURI(tt.uri); got != tt.want {
+				t.Errorf("normalizeURI(%q) = %q, want %q", tt.uri, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateCacheKeyConfig(t *testing.T) {
+	tests := []struct {
+		name         string
+		ignoreParams []string
+		includeHost  bool
+		hosts        []string
+		wantErr      bool
+	}{
+		{name: "valid patterns", ignoreParams: []string{"utm_*", "v?", "_[ab]"}},
+		{name: "invalid pattern", ignoreParams: []string{"utm_["}, wantErr: true},
+		{name: "hosts", includeHost: true, hosts: []string{"example.com", "www.example.com"}},
+		{name: "no hosts", includeHost: true, wantErr: true},
+		{name: "host with port", includeHost: true, hosts: []string{"example.com:8080"}, wantErr: true},
+		{name: "host with path", includeHost: true, hosts: []string{"example.com/"}, wantErr: true},
+		{name: "empty host", includeHost: true, hosts: []string{""}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			R := &Rendora{c: &rendoraConfig{}}
+			R.c.Cache.Key.IgnoreParams = tt.ignoreParams
+			R.c.Cache.Key.IncludeHost = tt.includeHost
+			R.c.Cache.Key.Hosts = tt.hosts
+
+			if err := R.validateCacheKeyConfig(); (err != nil) != tt.wantErr {
+				t.Errorf("validateCacheKeyConfig() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCacheKeyVariants(t *testing.T) {
+	const (
+		desktopUA = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/70.0.3538.77 Safari/537.36"
+		mobileUA  = "Mozilla/5.0 (Linux; Android 8.0.0; Pixel 2) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/70.0.3538.77 Mobile Safari/537.36"
+	)
+
+	tests := []struct {
+		name          string
+		includeHost   bool
+		includeDevice bool
+		host          string
+		userAgent     string
+		wantKey       string
+		wantURL       string
+	}{
+		{
+			name:      "no variants",
+			host:      "www.example.com",
+			userAgent: mobileUA,
+			wantKey:   "rendora:/page?a=1",
+			wantURL:   "https://example.com/page?a=1",
+		},
+		{
+			name:        "listed host",
+			includeHost: true,
+			host:        "WWW.example.com:8080",
+			userAgent:   desktopUA,
+			wantKey:     "rendora:/page?a=1 host=www.example.com",
+			wantURL:     "https://www.example.com/page?a=1",
+		},
+		{
+			name:        "unlisted host",
+			includeHost: true,
+			host:        "attacker.example",
+			userAgent:   desktopUA,
+			wantKey:     "rendora:/page?a=1 host=example.com",
+			wantURL:     "https://example.com/page?a=1",
+		},
+		{
+			name:          "mobile",
+			includeDevice: true,
+			host:          "www.example.com",
+			userAgent:     mobileUA,
+			wantKey:       "rendora:/page?a=1 device=mobile",
+			wantURL:       "https://example.com/page?a=1",
+		},
+		{
+			name:          "host and desktop",
+			includeHost:   true,
+			includeDevice: true,
+			host:          "www.example.com",
+			userAgent:     desktopUA,
+			wantKey:       "rendora:/page?a=1 host=www.example.com device=desktop",
+			wantURL:       "https://www.example.com/page?a=1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			R := &Rendora{c: &rendoraConfig{}}
+			R.c.Target.URL = "https://example.com"
+			R.c.Cache.KeyPrefix = "rendora"
+			R.c.Cache.Key.IncludeHost = tt.includeHost
+			R.c.Cache.Key.Hosts = []string{"www.example.com"}
+			R.c.Cache.Key.IncludeDevice = tt.includeDevice
+
+			r := httptest.NewRequest("GET", "/page?a=1", nil)
+			r.Host = tt.host
+			r.Header.Set("User-Agent", tt.userAgent)
+
+			variant := R.requestVariant(r)
+			if got := R.cacheKey(r.RequestURI, variant); got != tt.wantKey {
+				t.Errorf("cacheKey() = %q, want %q", got, tt.wantKey)
+			}
+			if got := R.renderURL(r.RequestURI, variant); got != tt.wantURL {
+				t.Errorf("renderURL() = %q, want %q", got, tt.wantURL)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2018 George Badawi.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rendora
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//cacheRuleConfig represents a per path cache rule as written in the config file
+type cacheRuleConfig struct {
+	Exact   string
+	Prefix  string
+	Regex   string
+	Timeout uint32
+	NoCache bool `mapstructure:"noCache"`
+}
+
+//cacheRule is a cacheRuleConfig with its regex compiled
+type cacheRule struct {
+	cacheRuleConfig
+	regex *regexp.Regexp
+}
+
+func (r *cacheRule) matches(uri string) bool {
+	switch {
+	case r.Exact != "":
+		return uri == r.Exact
+	case r.Prefix != "":
+		return strings.HasPrefix(uri, r.Prefix)
+	default:
+		return r.regex.MatchString(uri)
+	}
+}
+
+//initCacheRules validates and compiles the per path cache rules
+func (R *Rendora) initCacheRules() error {
+	R.cacheRules = nil
+	for i, rc := range R.c.Cache.Rules {
+		matchers := 0
+		for _, m := range []string{rc.Exact, rc.Prefix, rc.Regex} {
+			if m != "" {
+				matchers++
+			}
+		}
+		if matchers != 1 {
+			return fmt.Errorf("cache.rules[%d]: exactly one of exact, prefix or regex must be set", i)
+		}
+
+		rule := &cacheRule{
+			cacheRuleConfig: rc,
+		}
+		if rc.Regex != "" {
+			var err error
+			rule.regex, err = regexp.Compile(rc.Regex)
+			if err != nil {
+				return fmt.Errorf("cache.rules[%d]: invalid regex %q: %v", i, rc.Regex, err)
+			}
+		}
+		if !rc.NoCache && rc.Timeout == 0 {
+			return fmt.Errorf("cache.rules[%d]: either timeout or noCache must be set", i)
+		}
+
+		R.cacheRules = append(R.cacheRules, rule)
+	}
+	return nil
+}
+
+//isCacheableStatus checks whether responses with the status code can be stored in the cache
+func (R *Rendora) isCacheableStatus(status int) bool {
+	for _, s := range R.c.Cache.CacheableStatus {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+//getHeader returns the value of the response header regardless of its case (e.g. HTTP/2 headers are lowercase)
+func getHeader(headers map[string]string, name string) (string, bool) {
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+//headerCacheTimeout reads the cache directives set by the backend in the rendered response headers, it returns
+//false as the last value if the headers don't decide anything
+func (R *Rendora) headerCacheTimeout(headers map[string]string) (time.Duration, bool, bool) {
+	if v, ok := getHeader(headers, "X-Rendora-No-Cache"); ok {
+		if noCache, err := strconv.ParseBool(strings.TrimSpace(v)); err != nil || noCache {
+			return 0, false, true
+		}
+	}
+
+	if v, ok := getHeader(headers, "X-Rendora-TTL"); ok {
+		ttl, err := strconv.ParseUint(strings.TrimSpace(v), 10, 32)
+		if err == nil {
+			if ttl == 0 {
+				return 0, false, true
+			}
+			return time.Duration(ttl) * time.Second, true, true
+		}
+	}
+
+	if !R.c.Cache.HonorCacheControl {
+		return 0, false, false
+	}
+
+	v, ok := getHeader(headers, "Cache-Control")
+	if !ok {
+		return 0, false, false
+	}
+
+	var maxAge, sMaxAge int64 = -1, -1
+	// multiple headers with the same name are joined by new lines
+	for _, directive := range strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == '\n' }) {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store" || directive == "no-cache" || directive == "private":
+			return 0, false, true
+		case strings.HasPrefix(directive, "s-maxage="):
+			// invalid directives are ignored
+			if v, err := strconv.ParseInt(strings.Trim(directive[len("s-maxage="):], `"`), 10, 64); err == nil && v >= 0 {
+				sMaxAge = v
+			}
+		case strings.HasPrefix(directive, "max-age="):
+			if v, err := strconv.ParseInt(strings.Trim(directive[len("max-age="):], `"`), 10, 64); err == nil && v >= 0 {
+				maxAge = v
+			}
+		}
+	}
+
+	// Rendora is a shared cache, hence s-maxage takes precedence
+	if sMaxAge >= 0 {
+		maxAge = sMaxAge
+	}
+	if maxAge < 0 {
+		return 0, false, false
+	}
+	if maxAge == 0 {
+		return 0, false, true
+	}
+	return time.Duration(maxAge) * time.Second, true, true
+}
+
+//cacheTimeout returns how long the response of the uri stays fresh in the cache, it returns false if it must not be cached
+func (R *Rendora) cacheTimeout(uri string, resp *HeadlessResponse) (time.Duration, bool) {
+	if !R.isCacheableStatus(resp.Status) {
+		return 0, false
+	}
+
+	if timeout, cacheable, ok := R.headerCacheTimeout(resp.Headers); ok {
+		return timeout, cacheable
+	}
+
+	normalized := R.normalizeURI(uri)
+	for _, rule := range R.cacheRules {
+		if !rule.matches(normalized) {
+			continue
+		}
+		if rule.NoCache {
+			return 0, false
+		}
+		return time.Duration(rule.Timeout) * time.Second, true
+	}
+
+	return R.cache.DefaultTimeout, true
+}
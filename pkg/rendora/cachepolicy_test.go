@@ -0,0 +1,147 @@
+/*
+Copyright 2018 George Badawi.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rendora
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHeaderCacheTimeout(t *testing.T) {
+	tests := []struct {
+		name              string
+		honorCacheControl bool
+		headers           map[string]string
+		timeout           time.Duration
+		cacheable         bool
+		ok                bool
+	}{
+		{"no headers", true, nil, 0, false, false},
+		{"no-cache header", false, map[string]string{"X-Rendora-No-Cache": "true"}, 0, false, true},
+		{"lowercase no-cache header", false, map[string]string{"x-rendora-no-cache": "1"}, 0, false, true},
+		{"invalid no-cache header", false, map[string]string{"X-Rendora-No-Cache": "yes"}, 0, false, true},
+		{"disabled no-cache header", false, map[string]string{"X-Rendora-No-Cache": "false", "X-Rendora-TTL": "60"}, time.Minute, true, true},
+		{"ttl header", false, map[string]string{"X-Rendora-TTL": " 60 "}, time.Minute, true, true},
+		{"zero ttl header", false, map[string]string{"X-Rendora-TTL": "0"}, 0, false, true},
+		{"invalid ttl header", false, map[string]string{"X-Rendora-TTL": "-1"}, 0, false, false},
+		{"ttl header before Cache-Control", true, map[string]string{"X-Rendora-TTL": "60", "Cache-Control": "no-store"}, time.Minute, true, true},
+		{"Cache-Control not honored", false, map[string]string{"Cache-Control": "max-age=60"}, 0, false, false},
+		{"max-age", true, map[string]string{"Cache-Control": "public, max-age=60"}, time.Minute, true, true},
+		{"quoted max-age", true, map[string]string{"cache-control": `max-age="60"`}, time.Minute, true, true},
+		{"s-maxage before max-age", true, map[string]string{"Cache-Control": "max-age=60, s-maxage=3600"}, time.Hour, true, true},
+		{"zero s-maxage", true, map[string]string{"Cache-Control": "max-age=60, s-maxage=0"}, 0, false, true},
+		{"zero max-age", true, map[string]string{"Cache-Control": "max-age=0"}, 0, false, true},
+		{"invalid max-age", true, map[string]string{"Cache-Control": "max-age=soon"}, 0, false, false},
+		{"invalid s-maxage", true, map[string]string{"Cache-Control": "s-maxage=-1, max-age=60"}, time.Minute, true, true},
+		{"no-store", true, map[string]string{"Cache-Control": "max-age=60, no-store"}, 0, false, true},
+		{"no-cache", true, map[string]string{"Cache-Control": "No-Cache"}, 0, false, true},
+		{"private", true, map[string]string{"Cache-Control": "private, max-age=60"}, 0, false, true},
+		{"joined headers", true, map[string]string{"Cache-Control": "public\nmax-age=60"}, time.Minute, true, true},
+		{"no max-age", true, map[string]string{"Cache-Control": "public"}, 0, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			R := &Rendora{c: &rendoraConfig{}}
+			R.c.Cache.HonorCacheControl = tt.honorCacheControl
+
+			timeout, cacheable, ok := R.headerCacheTimeout(tt.headers)
+			if timeout != tt.timeout || cacheable != tt.cacheable || ok != tt.ok {
+				t.Errorf("headerCacheTimeout() = %v, %v, %v, want %v, %v, %v",
+					timeout, cacheable, ok, tt.timeout, tt.cacheable, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCacheTimeout(t *testing.T) {
+	rules := []cacheRuleConfig{
+		{Exact: "/", Timeout: 60},
+		{Prefix: "/account", NoCache: true},
+		{Regex: "^/blog/[0-9]+$", Timeout: 3600},
+		{Prefix: "/blog", Timeout: 600},
+	}
+
+	tests := []struct {
+		name      string
+		uri       string
+		status    int
+		headers   map[string]string
+		timeout   time.Duration
+		cacheable bool
+	}{
+		{"default timeout", "/about", 200, nil, 5 * time.Minute, true},
+		{"exact rule", "/", 200, nil, time.Minute, true},
+		{"exact rule with ignored param", "/?utm_source=x", 200, nil, time.Minute, true},
+		{"noCache rule", "/account/settings", 200, nil, 0, false},
+		{"regex rule", "/blog/42", 200, nil, time.Hour, true},
+		{"first matching rule", "/blog/42?page=2", 200, nil, 10 * time.Minute, true},
+		{"prefix rule", "/blog/latest", 200, nil, 10 * time.Minute, true},
+		{"uncacheable status", "/about", 500, nil, 0, false},
+		{"cacheable status", "/missing", 404, nil, 5 * time.Minute, true},
+		{"headers before rules", "/account/public", 200, map[string]string{"X-Rendora-TTL": "30"}, 30 * time.Second, true},
+		{"headers not caching", "/", 200, map[string]string{"Cache-Control": "no-store"}, 0, false},
+		{"uncacheable status before headers", "/", 503, map[string]string{"X-Rendora-TTL": "30"}, 0, false},
+	}
+
+	R := &Rendora{c: &rendoraConfig{}}
+	R.c.Cache.Rules = rules
+	R.c.Cache.CacheableStatus = []int{200, 404}
+	R.c.Cache.HonorCacheControl = true
+	R.c.Cache.Key.IgnoreParams = []string{"utm_*"}
+	R.cache = &cacheStore{
+		DefaultTimeout: 5 * time.Minute,
+	}
+	if err := R.initCacheRules(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &HeadlessResponse{
+				Status:  tt.status,
+				Headers: tt.headers,
+			}
+			timeout, cacheable := R.cacheTimeout(tt.uri, resp)
+			if timeout != tt.timeout || cacheable != tt.cacheable {
+				t.Errorf("cacheTimeout(%q) = %v, %v, want %v, %v", tt.uri, timeout, cacheable, tt.timeout, tt.cacheable)
+			}
+		})
+	}
+}
+
+func TestInitCacheRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    cacheRuleConfig
+		wantErr bool
+	}{
+		{"exact", cacheRuleConfig{Exact: "/", Timeout: 60}, false},
+		{"noCache", cacheRuleConfig{Prefix: "/account", NoCache: true}, false},
+		{"no matcher", cacheRuleConfig{Timeout: 60}, true},
+		{"two matchers", cacheRuleConfig{Exact: "/", Prefix: "/", Timeout: 60}, true},
+		{"invalid regex", cacheRuleConfig{Regex: "(", Timeout: 60}, true},
+		{"no timeout", cacheRuleConfig{Exact: "/"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			R := &Rendora{c: &rendoraConfig{}}
+			R.c.Cache.Rules = []cacheRuleConfig{tt.rule}
+			if err := R.initCacheRules(); (err != nil) != tt.wantErr {
+				t.Errorf("initCacheRules() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2018 George Badawi.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rendora
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"time"
+)
+
+//CacheTagIndex is implemented by the cache stores that can index the cache keys by tag, the keys of the stores not
+//implementing it are scanned instead when purging a tag
+type CacheTagIndex interface {
+	//Tag adds cKey to the keys of each tag index, the index is kept at least for ttl
+	Tag(cKey string, tagKeys []string, ttl time.Duration) error
+	//TaggedKeys returns the keys in the tag index, some of them may no longer exist or carry the tag
+	TaggedKeys(tagKey string) ([]string, error)
+	//Untag removes the keys from the tag index
+	Untag(tagKey string, cKeys []string) error
+}
+
+var (
+	metaTagRegex  = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	metaAttrRegex = regexp.MustCompile(`(?is)\b(name|content)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+)
+
+//splitTags splits a list of tags separated by spaces or commas
+func splitTags(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\r' || r == '\n'
+	})
+}
+
+//pageTags returns the tags declared by the rendered page in its response header or meta tag
+func (R *Rendora) pageTags(resp *HeadlessResponse) []string {
+	tagsConfig := &R.c.Cache.Tags
+	var ret []string
+	seen := make(map[string]bool)
+	add := func(tags []string) {
+		for _, tag := range tags {
+			if !seen[tag] {
+				seen[tag] = true
+				ret = append(ret, tag)
+			}
+		}
+	}
+
+	if tagsConfig.Header != "" {
+		if v, ok := getHeader(resp.Headers, tagsConfig.Header); ok {
+			add(splitTags(v))
+		}
+	}
+
+	if tagsConfig.Meta != "" {
+		for _, meta := range metaTagRegex.FindAllString(resp.Content, -1) {
+			var name, content string
+			for _, attr := range metaAttrRegex.FindAllStringSubmatch(meta, -1) {
+				value := attr[2] + attr[3] + attr[4]
+				if strings.EqualFold(attr[1], "name") {
+					name = value
+				} else {
+					content = value
+				}
+			}
+			if strings.EqualFold(name, tagsConfig.Meta) {
+				add(splitTags(html.UnescapeString(content)))
+			}
+		}
+	}
+
+	return ret
+}
+
+//cacheTagKey returns the key of the tag index in the current cache version, it can't collide with the cache keys
+func (R *Rendora) cacheTagKey(tag string) string {
+	return R.c.Cache.KeyPrefix + "#tag:" + R.getCacheVersion() + ":" + tag
+}
+
+//hasTag checks whether the tag is in tags
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+//tag indexes the key cKey by the tags of the stored entry
+func (c *cacheStore) tag(cKey string, tags []string, ttl time.Duration) error {
+	index, ok := c.store.(CacheTagIndex)
+	if !ok || len(tags) == 0 {
+		return nil
+	}
+
+	tagKeys := make([]string, len(tags))
+	for i, tag := range tags {
+		tagKeys[i] = c.rendora.cacheTagKey(tag)
+	}
+	return index.Tag(cKey, tagKeys, ttl)
+}
+
+//purgeTag removes all the entries carrying the tag and returns their count
+func (c *cacheStore) purgeTag(tag string) (int, error) {
+	tagKey := c.rendora.cacheTagKey(tag)
+	index, indexed := c.store.(CacheTagIndex)
+
+	var cKeys []string
+	var err error
+	if indexed {
+		cKeys, err = index.TaggedKeys(tagKey)
+	} else {
+		cKeys, err = c.scanKeys(c.rendora.cacheKeyPrefix())
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, cKey := range cKeys {
+		// the page may have been rendered again without the tag since it was indexed
+		entry, exists, err := c.lookup(cKey)
+		if err != nil {
+			return purged, err
+		}
+		if !exists || !hasTag(entry.Tags, tag) {
+			continue
+		}
+		if err = c.delete(cKey); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+
+	if indexed {
+		if err = index.Untag(tagKey, cKeys); err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
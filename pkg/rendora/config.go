@@ -14,11 +14,16 @@ limitations under the License.
 package rendora
 
 import (
+	"errors"
 	"log"
+	"net/http"
 	"net/url"
+	"sync/atomic"
+	"time"
 
 	"github.com/asaskevich/govalidator"
 	"github.com/spf13/viper"
+	"golang.org/x/sync/singleflight"
 )
 
 type backend struct {
@@ -47,22 +52,102 @@ type rendoraConfig struct {
 		AuthToken   string   `mapstructure:"authToken"`
 		BlockedURLs []string `mapstructure:"blockedURLs"`
 		Timeout     uint16   `valid:"range(5|30)"`
+		Retries     uint8    `valid:"range(0|10)"`
 		Internal    struct {
 			URL string `valid:"url"`
 		}
+		Pool struct {
+			Size    uint16 `valid:"range(1|1024)"`
+			MinIdle uint16 `mapstructure:"minIdle"`
+			MaxIdle uint16 `mapstructure:"maxIdle"`
+		} `mapstructure:"pool"`
 
 		WaitAfterDOMLoad uint16 `mapstructure:"waitAfterDOMLoad" valid:"range(0|5000)"`
+		Wait             struct {
+			waitConfig `mapstructure:",squash"`
+			Paths      []waitPathConfig
+		} `mapstructure:"wait"`
 	} `mapstructure:"headless"`
 
 	Cache struct {
-		Type    string `valid:"in(local|redis|none)"`
-		Timeout uint32 `valid:"range(1|4294967295)"`
-		Redis   struct {
-			Address   string `valid:"url"`
-			Password  string
-			DB        int    `valid:"range(0|15)"`
-			KeyPrefix string `mapstructure:"keyPrefix"`
+		Type                 string `valid:"in(local|redis|tiered|disk|none)"`
+		Timeout              uint32 `valid:"range(1|4294967295)"`
+		StaleTimeout         uint32 `mapstructure:"staleTimeout"`
+		StaleWhileRevalidate bool   `mapstructure:"staleWhileRevalidate"`
+		KeyPrefix            string `mapstructure:"keyPrefix"`
+		Namespace            struct {
+			Version     string
+			VersionFile string `mapstructure:"versionFile"`
+			VersionEnv  string `mapstructure:"versionEnv"`
+		} `mapstructure:"namespace"`
+		Redis struct {
+			Address      string `valid:"url"`
+			Username     string
+			Password     string
+			DB           int    `valid:"range(0|15)"`
+			KeyPrefix    string `mapstructure:"keyPrefix"`
+			MaxRetries   int    `mapstructure:"maxRetries"`
+			DialTimeout  uint32 `mapstructure:"dialTimeout"`
+			ReadTimeout  uint32 `mapstructure:"readTimeout"`
+			WriteTimeout uint32 `mapstructure:"writeTimeout"`
+			Pool         struct {
+				Size        int    `valid:"range(0|10000)"`
+				MinIdle     int    `mapstructure:"minIdle" valid:"range(0|10000)"`
+				Timeout     uint32 `mapstructure:"timeout"`
+				IdleTimeout uint32 `mapstructure:"idleTimeout"`
+			} `mapstructure:"pool"`
+			Sentinel struct {
+				MasterName string `mapstructure:"masterName"`
+				Addresses  []string
+			} `mapstructure:"sentinel"`
+			Cluster struct {
+				Addresses []string
+			} `mapstructure:"cluster"`
+			TLS struct {
+				Enable             bool
+				CAFile             string `mapstructure:"caFile"`
+				CertFile           string `mapstructure:"certFile"`
+				KeyFile            string `mapstructure:"keyFile"`
+				ServerName         string `mapstructure:"serverName"`
+				InsecureSkipVerify bool   `mapstructure:"insecureSkipVerify"`
+			} `mapstructure:"tls"`
 		} `mapstructure:"redis"`
+		Local struct {
+			MaxBytes   uint64 `mapstructure:"maxBytes"`
+			MaxEntries uint32 `mapstructure:"maxEntries"`
+		} `mapstructure:"local"`
+		Disk struct {
+			Path string
+		} `mapstructure:"disk"`
+		Tiered struct {
+			LocalTimeout    uint32 `mapstructure:"localTimeout" valid:"range(1|4294967295)"`
+			LocalMaxEntries uint32 `mapstructure:"localMaxEntries"`
+			Channel         string
+		} `mapstructure:"tiered"`
+		Rules             []cacheRuleConfig `mapstructure:"rules"`
+		CacheableStatus   []int             `mapstructure:"cacheableStatus"`
+		HonorCacheControl bool              `mapstructure:"honorCacheControl"`
+		Compression       string            `valid:"in(none|gzip),required"`
+		Tags              struct {
+			Header string
+			Meta   string
+		} `mapstructure:"tags"`
+		Refresh struct {
+			Enable bool
+			TopN   uint32 `mapstructure:"topN" valid:"range(1|100000)"`
+			Before uint32 `mapstructure:"before"`
+			Budget uint32 `mapstructure:"budget"`
+		} `mapstructure:"refresh"`
+		Key struct {
+			IgnoreParams       []string `mapstructure:"ignoreParams"`
+			SortParams         bool     `mapstructure:"sortParams"`
+			StripFragment      bool     `mapstructure:"stripFragment"`
+			StripTrailingSlash bool     `mapstructure:"stripTrailingSlash"`
+			LowercasePath      bool     `mapstructure:"lowercasePath"`
+			IncludeHost        bool     `mapstructure:"includeHost"`
+			Hosts              []string `mapstructure:"hosts"`
+			IncludeDevice      bool     `mapstructure:"includeDevice"`
+		} `mapstructure:"key"`
 	} `mapstructure:"cache"`
 
 	Output struct {
@@ -70,27 +155,43 @@ type rendoraConfig struct {
 	} `mapstructure:"output"`
 
 	Filters struct {
-		// Preset    string `valid:"in(all|bots)"`
 		UserAgent struct {
-			Default    string `mapstructure:"defaultPolicy" valid:"in(whitelist|blacklist)"`
-			Exceptions struct {
-				Keywords []string `valid:"lowercase"`
-				Exact    []string
-			} `mapstructure:"exceptions"`
+			Default    string                `mapstructure:"defaultPolicy" valid:"in(whitelist|blacklist)"`
+			Exceptions filterUserAgentConfig `mapstructure:"exceptions"`
+			Verify     struct {
+				Enable            bool
+				Resolver          string
+				Timeout           uint32 `valid:"range(1|60000)"`
+				CacheTimeout      uint32 `mapstructure:"cacheTimeout"`
+				TrustForwardedFor bool   `mapstructure:"trustForwardedFor"`
+			} `mapstructure:"verify"`
 		} `mapstructure:"userAgent"`
 		Paths struct {
 			Default string `mapstructure:"defaultPolicy" valid:"in(whitelist|blacklist)"`
 			Static  struct {
-				Exact  []string
-				Prefix []string
+				Exact      []string
+				Prefix     []string
+				Extensions []string
 			} `mapstructure:"static"`
-			Exceptions struct {
-				Exact  []string
-				Prefix []string
-			} `mapstructure:"exceptions"`
+			Exceptions filterPathConfig `mapstructure:"exceptions"`
 		} `mapstructure:"paths"`
+		Rules []filterRuleConfig `mapstructure:"rules"`
 	} `mapstructure:"filters"`
 
+	Warmup struct {
+		Sitemap     string
+		Concurrency uint16 `valid:"range(1|256)"`
+		Rate        float64
+		OnStart     bool `mapstructure:"onStart"`
+	} `mapstructure:"warmup"`
+
+	RenderServer struct {
+		Listen struct {
+			Address string `valid:"ip"`
+			Port    uint16 `valid:"range(1|65535)"`
+		}
+	} `mapstructure:"renderServer"`
+
 	Server struct {
 		Enable bool
 		Auth   struct {
@@ -107,6 +208,85 @@ type rendoraConfig struct {
 
 // InitConfig initializes the application configuration
 func (R *Rendora) initConfig() error {
+	err := R.loadConfig()
+	if err != nil {
+		return err
+	}
+
+	err = R.initCacheNamespace()
+	if err != nil {
+		return err
+	}
+
+	err = R.initCacheStore()
+	if err != nil {
+		return err
+	}
+
+	err = R.initSharedCacheVersion()
+	if err != nil {
+		return err
+	}
+
+	err = R.initCacheRules()
+	if err != nil {
+		return err
+	}
+
+	err = R.initFilters()
+	if err != nil {
+		return err
+	}
+
+	R.initCrawlerVerifier()
+
+	defaultBlockedURLs = R.c.Headless.BlockedURLs
+
+	R.backendURL, err = url.Parse(R.c.Backend.URL)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Configuration loaded")
+
+	if R.isHeadlessExternal() && !R.renderServer {
+		if R.c.Headless.URL == "" {
+			return errors.New("headless.url is required in the external headless mode")
+		}
+		R.externalClient = &http.Client{
+			Timeout: time.Duration(R.c.Headless.Timeout)*time.Second + 5*time.Second,
+		}
+		log.Println("Using the external render service", R.c.Headless.URL)
+	} else {
+		err = R.newHeadlessClient()
+
+		if err != nil {
+			return err
+		}
+
+		log.Println("Connected to headless Chrome")
+	}
+
+	if R.c.Server.Enable {
+		R.initPrometheus()
+	}
+
+	if R.c.Cache.Refresh.Enable && R.c.Cache.Type != "none" && !R.renderServer {
+		R.startRefresh()
+	}
+
+	if R.c.Warmup.OnStart && !R.renderServer {
+		if err = R.startWarmup("", nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+//loadConfig reads and validates the config file without initializing anything
+func (R *Rendora) loadConfig() error {
 
 	if R.cfgFile == "" {
 		viper.SetConfigName("config")
@@ -121,15 +301,46 @@ func (R *Rendora) initConfig() error {
 	viper.SetDefault("listen.address", "0.0.0.0")
 	viper.SetDefault("cache.type", "local")
 	viper.SetDefault("cache.timeout", 60*60)
-	viper.SetDefault("cache.redis.keyprefix", "__:::rendora:")
+	viper.SetDefault("cache.staleTimeout", 3600)
+	viper.SetDefault("cache.staleWhileRevalidate", true)
 	viper.SetDefault("cache.redis.password", "")
 	viper.SetDefault("cache.redis.db", 0)
+	viper.SetDefault("cache.local.maxBytes", 256<<20)
+	viper.SetDefault("cache.local.maxEntries", 0)
+	viper.SetDefault("cache.disk.path", "/var/cache/rendora")
+	viper.SetDefault("cache.tiered.localTimeout", 10)
+	viper.SetDefault("cache.tiered.localMaxEntries", 10000)
+	viper.SetDefault("cache.key.stripFragment", true)
+	viper.SetDefault("cache.honorCacheControl", false)
+	viper.SetDefault("cache.compression", "none")
+	viper.SetDefault("cache.tags.header", "Surrogate-Key")
+	viper.SetDefault("cache.tags.meta", "surrogate-key")
+	viper.SetDefault("cache.refresh.enable", false)
+	viper.SetDefault("cache.refresh.topN", 100)
+	viper.SetDefault("cache.refresh.before", 60)
+	viper.SetDefault("cache.refresh.budget", 30)
+	viper.SetDefault("cache.cacheableStatus", []int{200, 203, 204, 300, 301, 308, 404, 410})
+	viper.SetDefault("filters.paths.static.extensions", []string{
+		".js", ".mjs", ".css", ".map", ".json", ".xml", ".txt", ".pdf", ".zip", ".wasm",
+		".png", ".jpg", ".jpeg", ".gif", ".svg", ".ico", ".webp", ".avif", ".bmp",
+		".woff", ".woff2", ".ttf", ".otf", ".eot",
+		".mp4", ".webm", ".mp3", ".ogg", ".wav",
+	})
 	viper.SetDefault("output.minify", false)
 	viper.SetDefault("headless.mode", "default")
 	viper.SetDefault("headless.waitAfterDOMLoad", 0)
+	viper.SetDefault("headless.wait.strategy", waitDOMContentLoaded)
+	viper.SetDefault("headless.wait.idleTime", 500)
+	viper.SetDefault("headless.wait.maxInflight", 0)
 	viper.SetDefault("headless.timeout", 15)
+	viper.SetDefault("headless.retries", 2)
 	viper.SetDefault("headless.internal.url", "http://localhost:9222")
+	viper.SetDefault("headless.pool.size", 4)
+	viper.SetDefault("headless.pool.minIdle", 1)
+	viper.SetDefault("headless.pool.maxIdle", 4)
 	viper.SetDefault("filters.useragent.defaultPolicy", "blacklist")
+	viper.SetDefault("filters.useragent.verify.timeout", 2000)
+	viper.SetDefault("filters.useragent.verify.cacheTimeout", 3600)
 	viper.SetDefault("filters.paths.defaultPolicy", "whitelist")
 	viper.SetDefault("server.enable", "false")
 	viper.SetDefault("server.listen.address", "0.0.0.0")
@@ -137,6 +348,11 @@ func (R *Rendora) initConfig() error {
 	viper.SetDefault("server.auth.enable", false)
 	viper.SetDefault("server.auth.name", "X-Auth-Rendora")
 	viper.SetDefault("server.auth.value", "")
+	viper.SetDefault("renderServer.listen.address", "0.0.0.0")
+	viper.SetDefault("renderServer.listen.port", 9243)
+	viper.SetDefault("warmup.concurrency", 2)
+	viper.SetDefault("warmup.rate", 5)
+	viper.SetDefault("warmup.onStart", false)
 	viper.SetDefault("headless.blockedURLs", []string{
 		"*.png", "*.jpg", "*.jpeg", "*.webp", "*.gif", "*.css", "*.woff2", "*.svg", "*.woff", "*.ttf", "*.ico",
 		"https://www.youtube.com/*", "https://www.google-analytics.com/*",
@@ -159,31 +375,39 @@ func (R *Rendora) initConfig() error {
 		return err
 	}
 
-	R.initCacheStore()
-
-	defaultBlockedURLs = R.c.Headless.BlockedURLs
-
-	R.backendURL, err = url.Parse(R.c.Backend.URL)
-	if err != nil {
-		return err
+	// cache.redis.keyPrefix is still honored for older config files
+	if R.c.Cache.KeyPrefix == "" {
+		R.c.Cache.KeyPrefix = R.c.Cache.Redis.KeyPrefix
+	}
+	if R.c.Cache.KeyPrefix == "" {
+		R.c.Cache.KeyPrefix = defaultCacheKeyPrefix
 	}
 
-	log.Println("Configuration loaded")
+	if R.c.Server.Auth.Enable && (R.c.Server.Auth.Name == "" || R.c.Server.Auth.Value == "") {
+		return errors.New("server.auth.name and server.auth.value are required when server.auth.enable is set")
+	}
 
-	err = R.newHeadlessClient()
+	// a zero budget would never refresh any page
+	if R.c.Cache.Refresh.Enable && R.c.Cache.Refresh.Budget < 1 {
+		return errors.New("cache.refresh.budget must be at least 1 when cache.refresh.enable is set")
+	}
 
+	err = R.validateWaitConfig()
 	if err != nil {
 		return err
 	}
 
-	log.Println("Connected to headless Chrome")
-
-	if R.c.Server.Enable {
-		R.initPrometheus()
+	err = R.validateCacheKeyConfig()
+	if err != nil {
+		return err
 	}
 
 	return nil
+}
 
+//isHeadlessExternal checks whether pages are rendered by an external render service instead of a local headless Chrome instance
+func (R *Rendora) isHeadlessExternal() bool {
+	return R.c.Headless.Mode == "external" || R.c.HeadlessMode == "external"
 }
 
 //Rendora contains the main structure instance
@@ -194,4 +418,18 @@ type Rendora struct {
 	h          *headlessClient
 	metrics    *metrics
 	cfgFile    string
+
+	externalClient *http.Client
+	renderServer   bool
+	renders        singleflight.Group
+	cacheRules     []*cacheRule
+	filters        *compiledFilters
+	verifier       *crawlerVerifier
+	cacheVersion   atomic.Value
+	refresh        *refreshState
+	warmup         warmupState
+	apiConns       *connListener
+
+	//configuredCacheVersion is the cache version set by the config, the environment variable or the file
+	configuredCacheVersion string
 }
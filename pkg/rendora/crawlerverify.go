@@ -0,0 +1,286 @@
+/*
+Copyright 2018 George Badawi.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rendora
+
+import (
+	"context"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/singleflight"
+)
+
+//crawlerVerdictsMax limits the count of cached verdicts
+const crawlerVerdictsMax = 100000
+
+//CrawlerResolver resolves the hostnames of client IPs and the addresses of hostnames when verifying crawlers, it is
+//implemented by *net.Resolver
+type CrawlerResolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+//verifiableCrawler is a crawler whose IPs resolve to hostnames under its domains
+type verifiableCrawler struct {
+	name     string
+	keywords []string
+	domains  []string
+}
+
+//verifiableCrawlers are the crawlers documenting reverse DNS verification, a user agent claims to be the first crawler
+//whose keywords it contains
+var verifiableCrawlers = []verifiableCrawler{
+	{
+		name:     "google",
+		keywords: []string{"googlebot", "google-inspectiontool", "googleother", "storebot-google", "adsbot-google", "mediapartners-google"},
+		domains:  []string{"googlebot.com", "google.com"},
+	},
+	{
+		name:     "bing",
+		keywords: []string{"bingbot", "bingpreview", "adidxbot", "msnbot"},
+		domains:  []string{"search.msn.com"},
+	},
+	{
+		name:     "yahoo",
+		keywords: []string{"slurp"},
+		domains:  []string{"crawl.yahoo.net"},
+	},
+	{
+		name:     "yandex",
+		keywords: []string{"yandex"},
+		domains:  []string{"yandex.ru", "yandex.net", "yandex.com"},
+	},
+	{
+		name:     "baidu",
+		keywords: []string{"baiduspider"},
+		domains:  []string{"baidu.com", "baidu.jp"},
+	},
+	{
+		name:     "apple",
+		keywords: []string{"applebot"},
+		domains:  []string{"applebot.apple.com"},
+	},
+	{
+		name:     "petal",
+		keywords: []string{"petalbot"},
+		domains:  []string{"petalsearch.com", "aspiegel.com"},
+	},
+	{
+		name:     "seznam",
+		keywords: []string{"seznambot"},
+		domains:  []string{"seznam.cz"},
+	},
+	{
+		name:     "naver",
+		keywords: []string{"yeti/"},
+		domains:  []string{"naver.com"},
+	},
+}
+
+//crawlerVerdict is the cached result of verifying a client IP
+type crawlerVerdict struct {
+	verified  bool
+	expiresAt time.Time
+}
+
+//crawlerVerifier checks that the requests of known crawlers come from their own networks
+type crawlerVerifier struct {
+	resolver     CrawlerResolver
+	timeout      time.Duration
+	cacheTimeout time.Duration
+	mtx          sync.Mutex
+	verdicts     map[string]crawlerVerdict
+	group        singleflight.Group
+}
+
+//newCrawlerResolver returns the system resolver, or a resolver sending all its queries to the DNS server at address
+func newCrawlerResolver(address string) CrawlerResolver {
+	if address == "" {
+		return net.DefaultResolver
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	}
+}
+
+//initCrawlerVerifier sets up the crawler verification if it is enabled
+func (R *Rendora) initCrawlerVerifier() {
+	verifyConfig := &R.c.Filters.UserAgent.Verify
+	if !verifyConfig.Enable {
+		return
+	}
+
+	R.verifier = &crawlerVerifier{
+		resolver:     newCrawlerResolver(verifyConfig.Resolver),
+		timeout:      time.Duration(verifyConfig.Timeout) * time.Millisecond,
+		cacheTimeout: time.Duration(verifyConfig.CacheTimeout) * time.Second,
+		verdicts:     make(map[string]crawlerVerdict),
+	}
+}
+
+//claimedCrawler returns the verifiable crawler the user agent claims to be, if any
+func claimedCrawler(mua string) *verifiableCrawler {
+	lowerUA := strings.ToLower(mua)
+	for i := range verifiableCrawlers {
+		if isKeywordInSlice(verifiableCrawlers[i].keywords, lowerUA) {
+			return &verifiableCrawlers[i]
+		}
+	}
+	return nil
+}
+
+//hasDomain checks whether the hostname is any of the domains or a subdomain of them
+func hasDomain(host string, domains []string) bool {
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+//dnsNotFound is the DNSError.Err of the lookups failing because there is no such record, DNSError.IsNotFound requires
+//Go 1.13 but all versions use this error
+const dnsNotFound = "no such host"
+
+//isDNSNotFound checks whether the lookup failed because there is no such record, which is a definite answer unlike
+//timeouts and server failures
+func isDNSNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && !dnsErr.IsTimeout && !dnsErr.IsTemporary && dnsErr.Err == dnsNotFound
+}
+
+//lookup checks whether the ip reverse resolves to a hostname under the crawler's domains which resolves back to the ip
+func (v *crawlerVerifier) lookup(ip net.IP, crawler *verifiableCrawler) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), v.timeout)
+	defer cancel()
+
+	names, err := v.resolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		if isDNSNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	for _, name := range names {
+		host := strings.ToLower(strings.TrimSuffix(name, "."))
+		if !hasDomain(host, crawler.domains) {
+			continue
+		}
+
+		// anyone can set the reverse DNS of their own IPs, so the hostname must resolve back to the ip
+		addrs, err := v.resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			if isDNSNotFound(err) {
+				continue
+			}
+			return false, err
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+//verify checks whether the ip belongs to the crawler, the verdicts are cached except when the lookups fail
+func (v *crawlerVerifier) verify(ip net.IP, crawler *verifiableCrawler) bool {
+	key := crawler.name + " " + ip.String()
+	now := time.Now()
+
+	v.mtx.Lock()
+	verdict, ok := v.verdicts[key]
+	v.mtx.Unlock()
+	if ok && now.Before(verdict.expiresAt) {
+		return verdict.verified
+	}
+
+	ret, _, _ := v.group.Do(key, func() (interface{}, error) {
+		verified, err := v.lookup(ip, crawler)
+		if err != nil {
+			log.Printf("Verifying the %s crawler %s failed: %v\n", crawler.name, ip, err)
+			return false, nil
+		}
+
+		v.mtx.Lock()
+		defer v.mtx.Unlock()
+		if len(v.verdicts) >= crawlerVerdictsMax {
+			for k, verdict := range v.verdicts {
+				if now.After(verdict.expiresAt) {
+					delete(v.verdicts, k)
+				}
+			}
+			if len(v.verdicts) >= crawlerVerdictsMax {
+				v.verdicts = make(map[string]crawlerVerdict)
+			}
+		}
+		v.verdicts[key] = crawlerVerdict{
+			verified:  verified,
+			expiresAt: now.Add(v.cacheTimeout),
+		}
+		return verified, nil
+	})
+
+	return ret.(bool)
+}
+
+//crawlerClientIP returns the IP of the client, X-Forwarded-For and X-Real-Ip are used only if they are trusted since
+//they can be set by anyone
+func (R *Rendora) crawlerClientIP(c *gin.Context) net.IP {
+	if R.c.Filters.UserAgent.Verify.TrustForwardedFor {
+		return net.ParseIP(c.ClientIP())
+	}
+
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+//isVerifiedCrawler checks whether the request claiming to come from a known crawler really comes from it, requests
+//not claiming to come from a known crawler pass
+func (R *Rendora) isVerifiedCrawler(c *gin.Context) bool {
+	if R.verifier == nil {
+		return true
+	}
+
+	crawler := claimedCrawler(c.Request.Header.Get("User-Agent"))
+	if crawler == nil {
+		return true
+	}
+
+	ip := R.crawlerClientIP(c)
+	if ip != nil && R.verifier.verify(ip, crawler) {
+		return true
+	}
+
+	if R.c.Server.Enable {
+		R.metrics.CountCrawlerRejected.Inc()
+	}
+	return false
+}
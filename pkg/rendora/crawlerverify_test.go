@@ -0,0 +1,159 @@
+/*
+Copyright 2018 George Badawi.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rendora
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+//fakeCrawlerResolver answers the lookups from its records, the missing ones fail with NXDOMAIN unless err is set
+type fakeCrawlerResolver struct {
+	names map[string][]string
+	addrs map[string][]string
+	err   error
+
+	mtx     sync.Mutex
+	lookups int
+}
+
+func (r *fakeCrawlerResolver) count() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.lookups++
+}
+
+func (r *fakeCrawlerResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	r.count()
+	if r.err != nil {
+		return nil, r.err
+	}
+	names, ok := r.names[addr]
+	if !ok {
+		return nil, &net.DNSError{Err: dnsNotFound, Name: addr}
+	}
+	return names, nil
+}
+
+func (r *fakeCrawlerResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.count()
+	if r.err != nil {
+		return nil, r.err
+	}
+	addrs, ok := r.addrs[host]
+	if !ok {
+		return nil, &net.DNSError{Err: dnsNotFound, Name: host}
+	}
+	var ret []net.IPAddr
+	for _, addr := range addrs {
+		ret = append(ret, net.IPAddr{IP: net.ParseIP(addr)})
+	}
+	return ret, nil
+}
+
+func TestCrawlerVerify(t *testing.T) {
+	records := map[string][]string{
+		"crawl-66-249-66-1.googlebot.com": {"66.249.66.1"},
+		"rate-limited-proxy.google.com":   {"66.249.90.1"},
+		"spoofed.googlebot.com":           {"10.9.9.9"},
+		"user.googleusercontent.com":      {"35.1.1.1"},
+		"googlebot.com.evil.example":      {"10.1.1.1"},
+	}
+	names := map[string][]string{
+		"66.249.66.1": {"crawl-66-249-66-1.googlebot.com."},
+		"66.249.90.1": {"rate-limited-proxy.google.com."},
+		"10.0.0.1":    {"spoofed.googlebot.com."},
+		"35.1.1.1":    {"user.googleusercontent.com."},
+		"10.1.1.1":    {"googlebot.com.evil.example."},
+	}
+
+	tests := []struct {
+		name     string
+		ip       string
+		err      error
+		verified bool
+		// whether the verdict is cached so that verifying the ip again doesn't send lookups
+		cached bool
+	}{
+		{"matching reverse and forward lookups", "66.249.66.1", nil, true, true},
+		{"google.com hostname", "66.249.90.1", nil, true, true},
+		{"spoofed PTR record", "10.0.0.1", nil, false, true},
+		{"non-Google domain", "35.1.1.1", nil, false, true},
+		{"Google domain in a subdomain", "10.1.1.1", nil, false, true},
+		{"NXDOMAIN", "10.0.0.2", nil, false, true},
+		{"server failure", "66.249.66.1", &net.DNSError{Err: "server misbehaving", IsTemporary: true}, false, false},
+		{"timeout", "66.249.66.1", &net.DNSError{Err: "i/o timeout", IsTimeout: true}, false, false},
+		{"other failure", "66.249.66.1", errors.New("connection refused"), false, false},
+	}
+
+	crawler := claimedCrawler("Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)")
+	if crawler == nil || crawler.name != "google" {
+		t.Fatalf("claimedCrawler() = %v, want google", crawler)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := &fakeCrawlerResolver{
+				names: names,
+				addrs: records,
+				err:   tt.err,
+			}
+			v := &crawlerVerifier{
+				resolver:     resolver,
+				timeout:      time.Second,
+				cacheTimeout: time.Hour,
+				verdicts:     make(map[string]crawlerVerdict),
+			}
+
+			ip := net.ParseIP(tt.ip)
+			if got := v.verify(ip, crawler); got != tt.verified {
+				t.Errorf("verify() = %v, want %v", got, tt.verified)
+			}
+
+			lookups := resolver.lookups
+			if got := v.verify(ip, crawler); got != tt.verified {
+				t.Errorf("verify() again = %v, want %v", got, tt.verified)
+			}
+			if cached := resolver.lookups == lookups; cached != tt.cached {
+				t.Errorf("verdict cached = %v, want %v", cached, tt.cached)
+			}
+		})
+	}
+}
+
+func TestIsDNSNotFound(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"NXDOMAIN", &net.DNSError{Err: dnsNotFound, Name: "example.com"}, true},
+		{"temporary failure", &net.DNSError{Err: dnsNotFound, IsTemporary: true}, false},
+		{"timeout", &net.DNSError{Err: "i/o timeout", IsTimeout: true}, false},
+		{"server failure", &net.DNSError{Err: "server misbehaving"}, false},
+		{"not a DNS error", errors.New(dnsNotFound), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isDNSNotFound(tt.err); got != tt.want {
+				t.Errorf("isDNSNotFound(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+/*
+Copyright 2018 George Badawi.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rendora
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const diskStoreCleanupInterval = 4 * time.Minute
+
+//diskStore stores the cache entries as files so that they survive restarts, each file contains the key and the
+//expiration time (in unix nanoseconds) in its first two lines followed by the JSON-encoded entry
+type diskStore struct {
+	path string
+}
+
+func newDiskStore(path string) (*diskStore, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+
+	ret := &diskStore{
+		path: path,
+	}
+
+	go func() {
+		for range time.Tick(diskStoreCleanupInterval) {
+			ret.deleteExpired()
+		}
+	}()
+
+	return ret, nil
+}
+
+//filePath returns the path of the entry file, files are sharded by the first byte of the key hash
+func (s *diskStore) filePath(cKey string) string {
+	sum := sha256.Sum256([]byte(cKey))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(s.path, name[:2], name)
+}
+
+//readDiskEntryHeader reads the key and the expiration time of the entry file
+func readDiskEntryHeader(r *bufio.Reader) (string, time.Time, error) {
+	cKey, err := r.ReadString('\n')
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expiresStr, err := r.ReadString('\n')
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expires, err := strconv.ParseInt(strings.TrimSuffix(expiresStr, "\n"), 10, 64)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return strings.TrimSuffix(cKey, "\n"), time.Unix(0, expires), nil
+}
+
+func (s *diskStore) Get(cKey string) (*CacheEntry, bool, error) {
+	f, err := os.Open(s.filePath(cKey))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	storedKey, expires, err := readDiskEntryHeader(r)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if storedKey != cKey || time.Now().After(expires) {
+		return nil, false, nil
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, false, err
+	}
+	return decodeCacheEntry(data)
+}
+
+func (s *diskStore) Set(cKey string, entry *CacheEntry, ttl time.Duration) error {
+	data, err := encodeCacheEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	header := cKey + "\n" + strconv.FormatInt(time.Now().Add(ttl).UnixNano(), 10) + "\n"
+	return writeFileAtomic(s.filePath(cKey), []byte(header), data)
+}
+
+//writeFileAtomic writes the parts to a temporary file first so that readers never see partially written files
+func writeFileAtomic(fPath string, parts ...[]byte) error {
+	if err := os.MkdirAll(filepath.Dir(fPath), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(fPath), ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	for _, part := range parts {
+		if _, err = tmp.Write(part); err != nil {
+			break
+		}
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fPath)
+}
+
+//GetVersion reads the version state file, it is a single JSON line so it is never mistaken for an entry file
+func (s *diskStore) GetVersion(key string) ([]byte, bool, error) {
+	data, err := ioutil.ReadFile(s.filePath(key))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+func (s *diskStore) SetVersion(key string, state []byte) error {
+	return writeFileAtomic(s.filePath(key), state)
+}
+
+func (s *diskStore) Delete(cKey string) error {
+	err := os.Remove(s.filePath(cKey))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+//walk calls f with the file path, key and expiration time of every entry file
+func (s *diskStore) walk(f func(fPath, cKey string, expires time.Time)) error {
+	return filepath.Walk(s.path, func(fPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			return nil
+		}
+
+		file, err := os.Open(fPath)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		cKey, expires, err := readDiskEntryHeader(bufio.NewReader(file))
+		if err != nil {
+			// not an entry file
+			return nil
+		}
+		f(fPath, cKey, expires)
+		return nil
+	})
+}
+
+func (s *diskStore) Scan(prefix string) ([]string, error) {
+	var ret []string
+	now := time.Now()
+	err := s.walk(func(fPath, cKey string, expires time.Time) {
+		if strings.HasPrefix(cKey, prefix) && now.Before(expires) {
+			ret = append(ret, cKey)
+		}
+	})
+	return ret, err
+}
+
+//deleteExpired removes the expired entry files
+func (s *diskStore) deleteExpired() {
+	now := time.Now()
+	err := s.walk(func(fPath, cKey string, expires time.Time) {
+		if now.After(expires) {
+			os.Remove(fPath)
+		}
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
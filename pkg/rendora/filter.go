@@ -14,8 +14,14 @@ limitations under the License.
 package rendora
 
 import (
+	"fmt"
+	"log"
+	"path"
+	"regexp"
 	"strings"
+	"time"
 
+	"github.com/dlclark/regexp2"
 	"github.com/gin-gonic/gin"
 )
 
@@ -46,62 +52,327 @@ func hasPrefixinSlice(slice []string, str string) bool {
 	return false
 }
 
-//isWhitelisted checks whether the current request is whitelisted (i.e. should be SSR'ed) or not
-func (R *Rendora) isWhitelisted(c *gin.Context) bool {
-	mua := c.Request.Header.Get("User-Agent")
-	muaLower := strings.ToLower(mua)
-	filters := &R.c.Filters
+//uriPath returns the path of the request uri without its query string
+func uriPath(uri string) string {
+	if i := strings.IndexAny(uri, "?#"); i >= 0 {
+		return uri[:i]
+	}
+	return uri
+}
 
-	lenKeywords := len(filters.UserAgent.Exceptions.Keywords)
-	lenExceptions := len(filters.UserAgent.Exceptions.Exact)
+//patternList is a list of compiled regex or glob patterns
+type patternList []*regexp.Regexp
 
-	switch filters.UserAgent.Default {
-	case "whitelist":
+func (p patternList) matches(str string) bool {
+	for _, re := range p {
+		if re.MatchString(str) {
+			return true
+		}
+	}
+	return false
+}
 
-		if lenKeywords > 0 && isKeywordInSlice(filters.UserAgent.Exceptions.Keywords, muaLower) {
-			return false
+//filterUserAgentConfig represents the user agents matched by the user agent exceptions or a filter rule as written
+//in the config file
+type filterUserAgentConfig struct {
+	Keywords      []string `valid:"lowercase"`
+	Presets       []string
+	PresetExclude []string `mapstructure:"presetExclude" valid:"lowercase"`
+	Exact         []string
+	Regex         []string
+	Glob          []string
+}
+
+//filterPathConfig represents the paths matched by the path exceptions or a filter rule as written in the config file
+type filterPathConfig struct {
+	Exact  []string
+	Prefix []string
+	Regex  []string
+	Glob   []string
+}
+
+//userAgentRegexTimeout bounds the time spent matching a user agent regex since backtracking can take exponential time
+const userAgentRegexTimeout = 100 * time.Millisecond
+
+//regexList is a list of compiled user agent regexes, they support lookarounds (e.g. "bot(?!-blocked)") unlike the
+//patterns of patternList
+type regexList []*regexp2.Regexp
+
+func (p regexList) matches(str string) bool {
+	for _, re := range p {
+		matched, err := re.MatchString(str)
+		if err != nil {
+			log.Printf("Matching the user agent %q failed: %v\n", str, err)
+			continue
 		}
-		if lenExceptions > 0 && isInSlice(filters.UserAgent.Exceptions.Exact, mua) {
-			return false
+		if matched {
+			return true
 		}
-		break
-	case "blacklist":
-		if lenKeywords == 0 && lenExceptions == 0 {
-			return false
+	}
+	return false
+}
+
+//compileUserAgentRegexes compiles the regexes using a backtracking engine in its RE2 compatibility mode so that
+//lookarounds are supported in addition to the usual Go syntax, name is the config key reported in errors
+func compileUserAgentRegexes(name string, patterns []string) (regexList, error) {
+	var ret regexList
+	for _, pattern := range patterns {
+		re, err := regexp2.Compile(pattern, regexp2.RE2)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid pattern %q: %v", name, pattern, err)
 		}
-		if lenKeywords > 0 && isKeywordInSlice(filters.UserAgent.Exceptions.Keywords, muaLower) == false {
-			return false
+		re.MatchTimeout = userAgentRegexTimeout
+		ret = append(ret, re)
+	}
+	return ret, nil
+}
+
+//userAgentMatcher is a filterUserAgentConfig with its presets resolved and its patterns compiled
+type userAgentMatcher struct {
+	keywords       []string
+	presetKeywords []string
+	presetPatterns patternList
+	presetExclude  []string
+	exact          []string
+	regex          regexList
+	glob           patternList
+}
+
+//matchesKeywords checks whether the user agent matches any of the keywords, or any of the presets unless it contains
+//an excluded keyword
+func (m *userAgentMatcher) matchesKeywords(mua string) bool {
+	muaLower := strings.ToLower(mua)
+	if isKeywordInSlice(m.keywords, muaLower) {
+		return true
+	}
+	if isKeywordInSlice(m.presetExclude, muaLower) {
+		return false
+	}
+	return isKeywordInSlice(m.presetKeywords, muaLower) || m.presetPatterns.matches(mua)
+}
+
+//matches checks whether the user agent matches any of the keywords, exact user agents, regexes or globs
+func (m *userAgentMatcher) matches(mua string) bool {
+	return m.matchesKeywords(mua) ||
+		isInSlice(m.exact, mua) ||
+		m.regex.matches(mua) ||
+		m.glob.matches(mua)
+}
+
+//pathMatcher is a filterPathConfig with its patterns compiled
+type pathMatcher struct {
+	exact  []string
+	prefix []string
+	regex  patternList
+	glob   patternList
+}
+
+//matches checks whether the request uri matches any of the paths, globs are matched against the path only
+func (m *pathMatcher) matches(uri string) bool {
+	if isInSlice(m.exact, uri) || hasPrefixinSlice(m.prefix, uri) || m.regex.matches(uri) {
+		return true
+	}
+
+	if len(m.glob) == 0 {
+		return false
+	}
+	return m.glob.matches(uriPath(uri))
+}
+
+//compiledFilters holds the filter patterns compiled at config load
+type compiledFilters struct {
+	userAgent *userAgentMatcher
+	paths     *pathMatcher
+	rules     []*filterRule
+	//staticExtensions holds the lowercase static file extensions including their leading dot
+	staticExtensions map[string]bool
+}
+
+//globToRegexp converts a glob pattern to an anchored regular expression, if separator is set "*" doesn't match "/"
+//while "**" does, otherwise "*" matches any sequence of characters
+func globToRegexp(glob string, separator bool) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if separator && i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else if separator {
+				b.WriteString("[^/]*")
+			} else {
+				b.WriteString(".*")
+			}
+		case '?':
+			if separator {
+				b.WriteString("[^/]")
+			} else {
+				b.WriteString(".")
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
 		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
 
-		if lenExceptions > 0 && isInSlice(filters.UserAgent.Exceptions.Exact, mua) == false {
-			return false
+//compilePatterns compiles the patterns, name is the config key reported in errors
+func compilePatterns(name string, patterns []string, toRegexp func(string) string) (patternList, error) {
+	var ret patternList
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(toRegexp(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid pattern %q: %v", name, pattern, err)
 		}
+		ret = append(ret, re)
+	}
+	return ret, nil
+}
 
+//asIs is used to compile regex patterns as they are
+func asIs(pattern string) string {
+	return pattern
+}
+
+//compileUserAgentMatcher resolves the presets and compiles the patterns of the user agent config, name is the config
+//key reported in errors
+func compileUserAgentMatcher(name string, uc *filterUserAgentConfig) (*userAgentMatcher, error) {
+	ret := &userAgentMatcher{
+		exact: uc.Exact,
 	}
+	var err error
 
-	uri := c.Request.RequestURI
+	for _, keyword := range uc.Keywords {
+		ret.keywords = append(ret.keywords, strings.ToLower(keyword))
+	}
+	ret.presetKeywords, ret.presetPatterns, err = presetKeywords(name+".presets", uc.Presets)
+	if err != nil {
+		return nil, err
+	}
+	for _, keyword := range uc.PresetExclude {
+		ret.presetExclude = append(ret.presetExclude, strings.ToLower(keyword))
+	}
 
-	switch filters.Paths.Default {
-	case "blacklist":
-		if len(filters.Paths.Exceptions.Exact) > 0 && isInSlice(filters.Paths.Exceptions.Exact, uri) {
-			return true
-		}
+	ret.regex, err = compileUserAgentRegexes(name+".regex", uc.Regex)
+	if err != nil {
+		return nil, err
+	}
+	// user agent globs are case-insensitive like keywords
+	ret.glob, err = compilePatterns(name+".glob", uc.Glob, func(pattern string) string {
+		return "(?i)" + globToRegexp(pattern, false)
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		if len(filters.Paths.Exceptions.Prefix) > 0 && hasPrefixinSlice(filters.Paths.Exceptions.Prefix, uri) {
-			return true
+	return ret, nil
+}
+
+//compilePathMatcher compiles the patterns of the path config, name is the config key reported in errors
+func compilePathMatcher(name string, pc *filterPathConfig) (*pathMatcher, error) {
+	ret := &pathMatcher{
+		exact:  pc.Exact,
+		prefix: pc.Prefix,
+	}
+
+	var err error
+	ret.regex, err = compilePatterns(name+".regex", pc.Regex, asIs)
+	if err != nil {
+		return nil, err
+	}
+	ret.glob, err = compilePatterns(name+".glob", pc.Glob, func(pattern string) string {
+		return globToRegexp(pattern, true)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+//initFilters compiles the user agent and path exceptions, the static paths and the filter rules
+func (R *Rendora) initFilters() error {
+	filters := &R.c.Filters
+	ret := &compiledFilters{}
+
+	var err error
+	ret.userAgent, err = compileUserAgentMatcher("filters.userAgent.exceptions", &filters.UserAgent.Exceptions)
+	if err != nil {
+		return err
+	}
+	ret.paths, err = compilePathMatcher("filters.paths.exceptions", &filters.Paths.Exceptions)
+	if err != nil {
+		return err
+	}
+
+	ret.staticExtensions = make(map[string]bool)
+	for _, ext := range filters.Paths.Static.Extensions {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
 		}
+		ret.staticExtensions[ext] = true
+	}
+
+	ret.rules, err = compileFilterRules(filters.Rules)
+	if err != nil {
+		return err
+	}
+
+	R.filters = ret
+	return nil
+}
+
+//isStaticPath checks whether the request uri is a static file (e.g. scripts and images) which never needs SSR
+func (R *Rendora) isStaticPath(uri string) bool {
+	static := &R.c.Filters.Paths.Static
+	p := uriPath(uri)
+
+	if isInSlice(static.Exact, p) || hasPrefixinSlice(static.Prefix, p) {
+		return true
+	}
+	return R.filters.staticExtensions[strings.ToLower(path.Ext(p))]
+}
+
+//isWhitelisted checks whether the current request is whitelisted (i.e. should be SSR'ed) or not
+func (R *Rendora) isWhitelisted(c *gin.Context) bool {
+	filters := &R.c.Filters
+
+	if R.isStaticPath(c.Request.RequestURI) {
 		return false
+	}
+
+	switch filters.UserAgent.Default {
 	case "whitelist":
-		if len(filters.Paths.Exceptions.Exact) > 0 && isInSlice(filters.Paths.Exceptions.Exact, uri) {
+		if R.filters.userAgent.matches(c.Request.Header.Get("User-Agent")) {
 			return false
 		}
+	case "blacklist":
+		if !R.filters.userAgent.matches(c.Request.Header.Get("User-Agent")) {
+			return false
+		}
+	}
+
+	uri := c.Request.RequestURI
 
-		if len(filters.Paths.Exceptions.Prefix) > 0 && hasPrefixinSlice(filters.Paths.Exceptions.Prefix, uri) {
+	switch filters.Paths.Default {
+	case "blacklist":
+		if !R.filters.paths.matches(uri) {
+			return false
+		}
+	case "whitelist":
+		if R.filters.paths.matches(uri) {
 			return false
 		}
-		return true
 	default:
 		return false
 	}
 
+	// the DNS verification is the most expensive filter so it is checked last
+	return R.isVerifiedCrawler(c)
 }
@@ -0,0 +1,117 @@
+/*
+Copyright 2018 George Badawi.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rendora
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob      string
+		separator bool
+		str       string
+		want      bool
+	}{
+		{"/blog/*", true, "/blog/post", true},
+		{"/blog/*", true, "/blog/", true},
+		{"/blog/*", true, "/blog/2018/post", false},
+		{"/blog/**", true, "/blog/2018/post", true},
+		{"/blog/**/edit", true, "/blog/2018/post/edit", true},
+		{"/blog/**/edit", true, "/blog/2018/post", false},
+		{"/*.json", true, "/data.json", true},
+		{"/*.json", true, "/api/data.json", false},
+		{"/post-?", true, "/post-1", true},
+		{"/post-?", true, "/post-12", false},
+		{"/post?", true, "/post/", false},
+		{"/blog/*", false, "/blog/2018/post", true},
+		{"/post?", false, "/post/", true},
+		{"*bot*", false, "Mozilla/5.0 (compatible; examplebot/1.0)", true},
+		{"*bot", false, "examplebot/1.0", false},
+		{"/a.b", true, "/a.b", true},
+		{"/a.b", true, "/axb", false},
+		{"/a+(b)[c]", true, "/a+(b)[c]", true},
+		{"/page", true, "/page/extra", false},
+		{"/page", true, "/other/page", false},
+		{"", true, "", true},
+	}
+
+	for _, tt := range tests {
+		re := regexp.MustCompile(globToRegexp(tt.glob, tt.separator))
+		if got := re.MatchString(tt.str); got != tt.want {
+			t.Errorf("globToRegexp(%q, %v) matching %q = %v, want %v", tt.glob, tt.separator, tt.str, got, tt.want)
+		}
+	}
+}
+
+func TestUserAgentExceptions(t *testing.T) {
+	exceptions := filterUserAgentConfig{
+		Keywords:      []string{"examplebot"},
+		Presets:       []string{"seo-tools"},
+		PresetExclude: []string{"semrush"},
+		Exact:         []string{"Exact Agent/1.0"},
+		Regex:         []string{`^Regex(?!Blocked)`},
+		Glob:          []string{"*globbed*"},
+	}
+
+	// an exception matching any single entry is enough, whatever the default policy is
+	tests := []struct {
+		name      string
+		userAgent string
+		exception bool
+	}{
+		{"keyword", "Mozilla/5.0 (compatible; ExampleBot/2.0)", true},
+		{"preset", "Mozilla/5.0 (compatible; AhrefsBot/7.0)", true},
+		{"excluded preset", "Mozilla/5.0 (compatible; SemrushBot/7~bl)", false},
+		{"keyword despite presetExclude", "ExampleBot semrush", true},
+		{"exact", "Exact Agent/1.0", true},
+		{"exact with other case", "exact agent/1.0", false},
+		{"regex", "RegexAgent/1.0", true},
+		{"regex lookahead", "RegexBlocked/1.0", false},
+		{"glob", "Some GLOBBED agent", true},
+		{"no entry", "Mozilla/5.0 (Windows NT 10.0; Win64; x64)", false},
+	}
+
+	for _, policy := range []string{"blacklist", "whitelist"} {
+		R := &Rendora{c: &rendoraConfig{}}
+		R.c.Filters.UserAgent.Default = policy
+		R.c.Filters.UserAgent.Exceptions = exceptions
+		R.c.Filters.Paths.Default = "whitelist"
+		if err := R.initFilters(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tt := range tests {
+			t.Run(policy+"/"+tt.name, func(t *testing.T) {
+				if got := R.filters.userAgent.matches(tt.userAgent); got != tt.exception {
+					t.Errorf("matches(%q) = %v, want %v", tt.userAgent, got, tt.exception)
+				}
+
+				c, _ := gin.CreateTestContext(httptest.NewRecorder())
+				c.Request = httptest.NewRequest("GET", "/page", nil)
+				c.Request.Header.Set("User-Agent", tt.userAgent)
+
+				// the exceptions of the blacklist policy are SSR'ed while those of the whitelist policy aren't
+				want := tt.exception == (policy == "blacklist")
+				if got := R.isWhitelisted(c); got != want {
+					t.Errorf("isWhitelisted() = %v, want %v", got, want)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,313 @@
+/*
+Copyright 2018 George Badawi.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rendora
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+//filterFieldConfig represents a request header, cookie or query parameter matched by a filter rule as written in the
+//config file, it matches if any of its values matches any of the patterns, or if it is present when there aren't any
+type filterFieldConfig struct {
+	Name   string
+	Exact  []string
+	Prefix []string
+	Regex  []string
+	Glob   []string
+}
+
+//filterConditionConfig represents the conditions of a filter rule as written in the config file, all the set
+//conditions must match (e.g. both userAgent and path), a condition matches if any of its values matches
+type filterConditionConfig struct {
+	UserAgent filterUserAgentConfig `mapstructure:"userAgent"`
+	Path      filterPathConfig
+	Method    []string
+	Host      []string
+	Headers   []filterFieldConfig
+	Cookies   []filterFieldConfig
+	Query     []filterFieldConfig
+	All       []filterConditionConfig
+	Any       []filterConditionConfig
+	None      []filterConditionConfig
+}
+
+//filterRuleConfig represents a filter rule as written in the config file
+type filterRuleConfig struct {
+	Match  filterConditionConfig
+	Action string
+}
+
+//fieldMatcher is a filterFieldConfig with its patterns compiled
+type fieldMatcher struct {
+	name     string
+	exact    []string
+	prefix   []string
+	patterns patternList
+}
+
+func (m *fieldMatcher) matches(values []string) bool {
+	if len(m.exact) == 0 && len(m.prefix) == 0 && len(m.patterns) == 0 {
+		return len(values) > 0
+	}
+
+	for _, v := range values {
+		if isInSlice(m.exact, v) || hasPrefixinSlice(m.prefix, v) || m.patterns.matches(v) {
+			return true
+		}
+	}
+	return false
+}
+
+//filterCondition is a filterConditionConfig with its patterns compiled, the conditions that aren't set are nil
+type filterCondition struct {
+	userAgent *userAgentMatcher
+	path      *pathMatcher
+	methods   []string
+	hosts     patternList
+	headers   []*fieldMatcher
+	cookies   []*fieldMatcher
+	query     []*fieldMatcher
+	all       []*filterCondition
+	any       []*filterCondition
+	none      []*filterCondition
+}
+
+//filterRule is a filterRuleConfig with its conditions compiled
+type filterRule struct {
+	condition *filterCondition
+	action    string
+}
+
+//requestHost returns the host of the request without its port
+func requestHost(req *http.Request) string {
+	if host, _, err := net.SplitHostPort(req.Host); err == nil {
+		return host
+	}
+	return req.Host
+}
+
+//cookieValues returns the values of all the request cookies named name
+func cookieValues(req *http.Request, name string) []string {
+	var ret []string
+	for _, cookie := range req.Cookies() {
+		if cookie.Name == name {
+			ret = append(ret, cookie.Value)
+		}
+	}
+	return ret
+}
+
+//matches checks whether the request matches all the set conditions, an empty condition matches any request
+func (f *filterCondition) matches(c *gin.Context) bool {
+	req := c.Request
+
+	if f.userAgent != nil && !f.userAgent.matches(req.Header.Get("User-Agent")) {
+		return false
+	}
+	if f.path != nil && !f.path.matches(req.RequestURI) {
+		return false
+	}
+	if len(f.methods) > 0 && !isInSlice(f.methods, req.Method) {
+		return false
+	}
+	if len(f.hosts) > 0 && !f.hosts.matches(requestHost(req)) {
+		return false
+	}
+
+	for _, m := range f.headers {
+		if !m.matches(req.Header[textproto.CanonicalMIMEHeaderKey(m.name)]) {
+			return false
+		}
+	}
+	for _, m := range f.cookies {
+		if !m.matches(cookieValues(req, m.name)) {
+			return false
+		}
+	}
+	if len(f.query) > 0 {
+		query := req.URL.Query()
+		for _, m := range f.query {
+			if !m.matches(query[m.name]) {
+				return false
+			}
+		}
+	}
+
+	for _, sub := range f.all {
+		if !sub.matches(c) {
+			return false
+		}
+	}
+	if len(f.any) > 0 {
+		matched := false
+		for _, sub := range f.any {
+			if sub.matches(c) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	for _, sub := range f.none {
+		if sub.matches(c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+//compileFieldMatchers compiles the patterns of the header, cookie or query parameter conditions, name is the config
+//key reported in errors
+func compileFieldMatchers(name string, fields []filterFieldConfig) ([]*fieldMatcher, error) {
+	var ret []*fieldMatcher
+	for i, fc := range fields {
+		fieldName := fmt.Sprintf("%s[%d]", name, i)
+		if fc.Name == "" {
+			return nil, fmt.Errorf("%s: name must be set", fieldName)
+		}
+
+		regex, err := compilePatterns(fieldName+".regex", fc.Regex, asIs)
+		if err != nil {
+			return nil, err
+		}
+		glob, err := compilePatterns(fieldName+".glob", fc.Glob, func(pattern string) string {
+			return globToRegexp(pattern, false)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, &fieldMatcher{
+			name:     fc.Name,
+			exact:    fc.Exact,
+			prefix:   fc.Prefix,
+			patterns: append(regex, glob...),
+		})
+	}
+	return ret, nil
+}
+
+//compileFilterConditions compiles the nested conditions, name is the config key reported in errors
+func compileFilterConditions(name string, conditions []filterConditionConfig) ([]*filterCondition, error) {
+	var ret []*filterCondition
+	for i := range conditions {
+		condition, err := compileFilterCondition(fmt.Sprintf("%s[%d]", name, i), &conditions[i])
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, condition)
+	}
+	return ret, nil
+}
+
+//compileFilterCondition compiles the patterns of the condition and its nested conditions, name is the config key
+//reported in errors
+func compileFilterCondition(name string, cc *filterConditionConfig) (*filterCondition, error) {
+	ret := &filterCondition{}
+	var err error
+
+	uc := &cc.UserAgent
+	if len(uc.Keywords)+len(uc.Presets)+len(uc.Exact)+len(uc.Regex)+len(uc.Glob) > 0 {
+		ret.userAgent, err = compileUserAgentMatcher(name+".userAgent", uc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pc := &cc.Path
+	if len(pc.Exact)+len(pc.Prefix)+len(pc.Regex)+len(pc.Glob) > 0 {
+		ret.path, err = compilePathMatcher(name+".path", pc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, method := range cc.Method {
+		ret.methods = append(ret.methods, strings.ToUpper(method))
+	}
+
+	// hosts are globs matched case-insensitively without the port (e.g. *.example.com)
+	ret.hosts, err = compilePatterns(name+".host", cc.Host, func(pattern string) string {
+		return "(?i)" + globToRegexp(pattern, false)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if ret.headers, err = compileFieldMatchers(name+".headers", cc.Headers); err != nil {
+		return nil, err
+	}
+	if ret.cookies, err = compileFieldMatchers(name+".cookies", cc.Cookies); err != nil {
+		return nil, err
+	}
+	if ret.query, err = compileFieldMatchers(name+".query", cc.Query); err != nil {
+		return nil, err
+	}
+
+	if ret.all, err = compileFilterConditions(name+".all", cc.All); err != nil {
+		return nil, err
+	}
+	if ret.any, err = compileFilterConditions(name+".any", cc.Any); err != nil {
+		return nil, err
+	}
+	if ret.none, err = compileFilterConditions(name+".none", cc.None); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+//compileFilterRules validates and compiles the filter rules
+func compileFilterRules(rules []filterRuleConfig) ([]*filterRule, error) {
+	var ret []*filterRule
+	for i := range rules {
+		rc := &rules[i]
+		switch rc.Action {
+		case "render", "proxy", "deny":
+		default:
+			return nil, fmt.Errorf("filters.rules[%d]: action must be render, proxy or deny", i)
+		}
+
+		condition, err := compileFilterCondition(fmt.Sprintf("filters.rules[%d].match", i), &rc.Match)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, &filterRule{
+			condition: condition,
+			action:    rc.Action,
+		})
+	}
+	return ret, nil
+}
+
+//filterRuleAction returns the action of the first filter rule matching the request, or an empty string if none of
+//them matches
+func (R *Rendora) filterRuleAction(c *gin.Context) string {
+	for _, rule := range R.filters.rules {
+		if rule.condition.matches(c) {
+			return rule.action
+		}
+	}
+	return ""
+}
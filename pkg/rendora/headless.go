@@ -21,11 +21,14 @@ import (
 	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mafredri/cdp"
 	"github.com/mafredri/cdp/devtool"
 	"github.com/mafredri/cdp/protocol/dom"
+	"github.com/mafredri/cdp/protocol/emulation"
+	"github.com/mafredri/cdp/protocol/inspector"
 	"github.com/mafredri/cdp/protocol/network"
 	"github.com/mafredri/cdp/protocol/page"
 	"github.com/mafredri/cdp/rpcc"
@@ -33,12 +36,32 @@ import (
 
 var defaultBlockedURLs []string
 
-//headlessClient contains the info of the headless client, most importantly the cdp.Client
-type headlessClient struct {
+//the screen and user agent of the mobile device emulated when rendering pages for mobiles
+const (
+	mobileWidth       = 412
+	mobileHeight      = 915
+	mobileScaleFactor = 2.625
+	mobileUserAgent   = "Mozilla/5.0 (Linux; Android 10; K) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36"
+)
+
+//headlessTab is a single headless Chrome target (i.e. tab) leased by the pool for one render at a time
+type headlessTab struct {
+	target  *devtool.Target
 	RPCConn *rpcc.Conn
 	C       *cdp.Client
-	Mtx     *sync.Mutex
+	crashed int32
+	mobile  bool
+}
+
+//headlessClient contains the info of the headless client, most importantly the pool of tabs
+type headlessClient struct {
+	devt    *devtool.DevTools
+	devtMtx *sync.Mutex
+	idle    chan *headlessTab
+	slots   chan struct{}
 	rendora *Rendora
+	//toppingUp is set while idle tabs are being opened in the background
+	toppingUp int32
 }
 
 func resolveURLHostname(arg string) (string, error) {
@@ -94,8 +117,18 @@ func checkHeadless(arg string) error {
 
 //NewHeadlessClient creates HeadlessClient
 func (R *Rendora) newHeadlessClient() error {
+	pool := &R.c.Headless.Pool
+	if pool.MaxIdle > pool.Size {
+		pool.MaxIdle = pool.Size
+	}
+	if pool.MinIdle > pool.MaxIdle {
+		pool.MinIdle = pool.MaxIdle
+	}
+
 	ret := &headlessClient{
-		Mtx: &sync.Mutex{},
+		devtMtx: &sync.Mutex{},
+		idle:    make(chan *headlessTab, pool.MaxIdle),
+		slots:   make(chan struct{}, pool.Size),
 		rendora: R,
 	}
 	ctx := context.Background()
@@ -105,42 +138,100 @@ func (R *Rendora) newHeadlessClient() error {
 		return err
 	}
 
+	if _, err = ret.resolve(); err != nil {
+		return err
+	}
+
+	for i := uint16(0); i < pool.MinIdle; i++ {
+		tab, err := ret.newTab(ctx)
+		if err != nil {
+			return err
+		}
+		ret.idle <- tab
+	}
+
+	R.h = ret
+
+	return nil
+}
+
+//resolve resolves the headless Chrome instance address again, e.g. in case its container got restarted with a new IP
+func (c *headlessClient) resolve() (*devtool.DevTools, error) {
 	// looks like cdp doesn't resolve hostnames automatically, may lead to problems when used with container networks
-	resolvedURL, err := resolveURLHostname(R.c.Headless.Internal.URL)
+	resolvedURL, err := resolveURLHostname(c.rendora.c.Headless.Internal.URL)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	devt := devtool.New(resolvedURL)
-	pt, err := devt.Get(ctx, devtool.Page)
+	c.devtMtx.Lock()
+	defer c.devtMtx.Unlock()
+	c.devt = devtool.New(resolvedURL)
+	return c.devt, nil
+}
+
+func (c *headlessClient) devTools() *devtool.DevTools {
+	c.devtMtx.Lock()
+	defer c.devtMtx.Unlock()
+	return c.devt
+}
+
+//newTab creates a new headless Chrome target and prepares it for rendering
+func (c *headlessClient) newTab(ctx context.Context) (*headlessTab, error) {
+	devt := c.devTools()
+	pt, err := devt.Create(ctx)
 	if err != nil {
+		log.Println("Cannot create a headless Chrome tab, resolving the headless Chrome instance again:", err)
+		devt, err = c.resolve()
+		if err != nil {
+			return nil, err
+		}
 		pt, err = devt.Create(ctx)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
+	ret := &headlessTab{
+		target: pt,
+	}
+
 	ret.RPCConn, err = rpcc.DialContext(ctx, pt.WebSocketDebuggerURL)
 	if err != nil {
-		return err
+		devt.Close(ctx, pt)
+		return nil, err
 	}
 
 	ret.C = cdp.NewClient(ret.RPCConn)
 
-	domContent, err := ret.C.Page.DOMContentEventFired(ctx)
+	if err = ret.setup(ctx); err != nil {
+		c.closeTab(ret)
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+//setup enables the required domains and applies the extra headers and blocked URLs to the tab
+func (t *headlessTab) setup(ctx context.Context) error {
+	if err := t.C.Page.Enable(ctx); err != nil {
+		return err
+	}
+
+	err := t.C.Network.Enable(ctx, nil)
 	if err != nil {
 		return err
 	}
-	defer domContent.Close()
 
-	if err = ret.C.Page.Enable(ctx); err != nil {
+	if err = t.C.Inspector.Enable(ctx); err != nil {
 		return err
 	}
 
-	err = ret.C.Network.Enable(ctx, nil)
+	// the stream lives as long as the connection, hence it is not bound to ctx
+	targetCrashed, err := t.C.Inspector.TargetCrashed(context.Background())
 	if err != nil {
 		return err
 	}
+	go t.watchCrash(targetCrashed)
 
 	headers := map[string]string{
 		"X-Rendora-Type": "RENDER",
@@ -151,72 +242,270 @@ func (R *Rendora) newHeadlessClient() error {
 		return err
 	}
 
-	err = ret.C.Network.SetExtraHTTPHeaders(ctx, network.NewSetExtraHTTPHeadersArgs(headersStr))
+	err = t.C.Network.SetExtraHTTPHeaders(ctx, network.NewSetExtraHTTPHeadersArgs(headersStr))
 	if err != nil {
 		return err
 	}
 
 	blockedURLs := network.NewSetBlockedURLsArgs(defaultBlockedURLs)
 
-	err = ret.C.Network.SetBlockedURLs(ctx, blockedURLs)
+	return t.C.Network.SetBlockedURLs(ctx, blockedURLs)
+}
 
-	if err != nil {
-		return err
+//watchCrash marks the tab as broken and closes its connection once the target crashes so in-flight calls fail immediately
+func (t *headlessTab) watchCrash(targetCrashed inspector.TargetCrashedClient) {
+	defer targetCrashed.Close()
+	if _, err := targetCrashed.Recv(); err != nil {
+		return
 	}
+	log.Println("Headless Chrome tab crashed:", t.target.ID)
+	atomic.StoreInt32(&t.crashed, 1)
+	t.RPCConn.Close()
+}
 
-	R.h = ret
+//emulate switches the tab between emulating a mobile device and rendering for desktops
+func (t *headlessTab) emulate(ctx context.Context, mobile bool) error {
+	if t.mobile == mobile {
+		return nil
+	}
+
+	if mobile {
+		metrics := emulation.NewSetDeviceMetricsOverrideArgs(mobileWidth, mobileHeight, mobileScaleFactor, true)
+		if err := t.C.Emulation.SetDeviceMetricsOverride(ctx, metrics); err != nil {
+			return err
+		}
+		if err := t.C.Emulation.SetUserAgentOverride(ctx, emulation.NewSetUserAgentOverrideArgs(mobileUserAgent)); err != nil {
+			return err
+		}
+	} else {
+		if err := t.C.Emulation.ClearDeviceMetricsOverride(ctx); err != nil {
+			return err
+		}
+		// an empty user agent removes the override
+		if err := t.C.Emulation.SetUserAgentOverride(ctx, emulation.NewSetUserAgentOverrideArgs("")); err != nil {
+			return err
+		}
+	}
 
+	t.mobile = mobile
 	return nil
 }
 
-//GoTo navigates to the url, fetches the DOM and returns HeadlessResponse
-func (c *headlessClient) getResponse(uri string) (*HeadlessResponse, error) {
+//isBroken checks whether the tab crashed or its websocket connection got closed
+func (t *headlessTab) isBroken() bool {
+	return atomic.LoadInt32(&t.crashed) == 1 || t.RPCConn.Context().Err() != nil
+}
+
+//closeTab closes the websocket connection and the headless Chrome target of the tab
+func (c *headlessClient) closeTab(t *headlessTab) {
+	t.RPCConn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.devTools().Close(ctx, t.target); err != nil && !t.isBroken() {
+		log.Println(err)
+	}
+}
+
+//lease waits for a free slot in the pool and returns an idle tab, or a new one if none is idle
+func (c *headlessClient) lease(ctx context.Context) (*headlessTab, error) {
+	select {
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 
-	c.Mtx.Lock()
-	defer c.Mtx.Unlock()
+	for tab := c.popIdle(); tab != nil; tab = c.popIdle() {
+		if !tab.isBroken() {
+			c.topUp()
+			return tab, nil
+		}
+		c.closeTab(tab)
+	}
+
+	tab, err := c.newTab(ctx)
+	if err != nil {
+		<-c.slots
+		return nil, err
+	}
+	return tab, nil
+}
+
+//popIdle returns an idle tab or nil if there isn't any
+func (c *headlessClient) popIdle() *headlessTab {
+	select {
+	case tab := <-c.idle:
+		return tab
+	default:
+		return nil
+	}
+}
+
+//release returns the tab to the idle list, tabs are closed if they are broken or the idle list is full
+func (c *headlessClient) release(t *headlessTab, broken bool) {
+	defer func() { <-c.slots }()
+
+	if !broken {
+		select {
+		case c.idle <- t:
+			return
+		default:
+		}
+	}
+	c.closeTab(t)
+	c.topUp()
+}
+
+//topUp opens tabs in the background until there are minIdle idle tabs again, e.g. after idle tabs got leased or broken
+//tabs got closed, the pool never exceeds its size
+func (c *headlessClient) topUp() {
+	pool := &c.rendora.c.Headless.Pool
+	if len(c.idle) >= int(pool.MinIdle) || !atomic.CompareAndSwapInt32(&c.toppingUp, 0, 1) {
+		return
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&c.toppingUp, 0)
+
+		for len(c.idle) < int(pool.MinIdle) && len(c.idle)+len(c.slots) < int(pool.Size) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.rendora.c.Headless.Timeout)*time.Second)
+			tab, err := c.newTab(ctx)
+			cancel()
+			if err != nil {
+				log.Println("Cannot open an idle headless Chrome tab:", err)
+				return
+			}
+
+			select {
+			case c.idle <- tab:
+			default:
+				c.closeTab(tab)
+				return
+			}
+		}
+	}()
+}
+
+//occupancy returns the number of busy and idle tabs in the pool
+func (c *headlessClient) occupancy() (int, int) {
+	idle := len(c.idle)
+	busy := len(c.slots)
+	return busy, idle
+}
+
+//GoTo navigates to the url, fetches the DOM and returns HeadlessResponse, mobile devices are emulated if mobile is set
+func (c *headlessClient) getResponse(uri string, mobile bool) (*HeadlessResponse, error) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.rendora.c.Headless.Timeout)*time.Second)
 	defer cancel()
 
-	timeStart := time.Now()
-	navArgs := page.NewNavigateArgs(uri)
-	networkResponse, err := c.C.Network.ResponseReceived(ctx)
+	var ret *HeadlessResponse
+	var err error
+	backoff := 250 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		ret, retry, err = c.tryRender(ctx, uri, mobile)
+		if err == nil || !retry || attempt >= int(c.rendora.c.Headless.Retries) {
+			break
+		}
+
+		log.Printf("Rendering %s failed, retrying after %v: %v\n", uri, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, err
+		}
+		backoff *= 2
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = c.C.Page.Navigate(ctx, navArgs)
+	if c.rendora.c.Server.Enable {
+		c.rendora.metrics.Duration.Observe(ret.Latency)
+	}
+
+	return ret, nil
+}
+
+//tryRender leases a tab and renders the url, it also reports whether the failure is recoverable by retrying with a new tab
+func (c *headlessClient) tryRender(ctx context.Context, uri string, mobile bool) (*HeadlessResponse, bool, error) {
+	tab, err := c.lease(ctx)
 	if err != nil {
+		return nil, ctx.Err() == nil, err
+	}
+
+	ret, err := c.render(ctx, tab, uri, mobile)
+	if err != nil {
+		broken := tab.isBroken()
+		c.release(tab, true)
+		return nil, broken && ctx.Err() == nil, err
+	}
+
+	c.release(tab, false)
+	return ret, false, nil
+}
+
+//render navigates the leased tab to the url, fetches the DOM and returns HeadlessResponse
+func (c *headlessClient) render(ctx context.Context, t *headlessTab, uri string, mobile bool) (*HeadlessResponse, error) {
+	timeStart := time.Now()
+	if err := t.emulate(ctx, mobile); err != nil {
 		return nil, err
 	}
 
-	responseReply, err := networkResponse.Recv()
+	navArgs := page.NewNavigateArgs(uri)
+	networkResponse, err := t.C.Network.ResponseReceived(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer networkResponse.Close()
 
+	waiter, err := newPageWaiter(ctx, t, c.getWaitConfig(uri))
 	if err != nil {
 		return nil, err
 	}
+	defer waiter.close()
 
-	domContent, err := c.C.Page.DOMContentEventFired(ctx)
+	navReply, err := t.C.Page.Navigate(ctx, navArgs)
 	if err != nil {
 		return nil, err
 	}
-	defer domContent.Close()
+	if navReply.ErrorText != nil {
+		return nil, errors.New(*navReply.ErrorText)
+	}
 
-	waitUntil := c.rendora.c.Headless.WaitAfterDOMLoad
-	if waitUntil > 0 {
-		time.Sleep(time.Duration(waitUntil) * time.Millisecond)
+	// skip responses belonging to requests of the previously rendered page in this tab
+	var responseReply *network.ResponseReceivedReply
+	for {
+		responseReply, err = networkResponse.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if responseReply.Type == network.ResourceTypeDocument &&
+			(navReply.LoaderID == nil || responseReply.LoaderID == *navReply.LoaderID) {
+			break
+		}
 	}
 
-	if _, err = domContent.Recv(); err != nil {
+	if err = waiter.wait(ctx, t); err != nil {
 		return nil, err
 	}
 
-	doc, err := c.C.DOM.GetDocument(ctx, nil)
+	waitUntil := c.rendora.c.Headless.WaitAfterDOMLoad
+	if waitUntil > 0 {
+		select {
+		case <-time.After(time.Duration(waitUntil) * time.Millisecond):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	doc, err := t.C.DOM.GetDocument(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	domResponse, err := c.C.DOM.GetOuterHTML(ctx, &dom.GetOuterHTMLArgs{
+	domResponse, err := t.C.DOM.GetOuterHTML(ctx, &dom.GetOuterHTMLArgs{
 		NodeID: &doc.Root.NodeID,
 	})
 	if err != nil {
@@ -225,11 +514,6 @@ func (c *headlessClient) getResponse(uri string) (*HeadlessResponse, error) {
 
 	elapsed := float64(time.Since(timeStart)) / float64(time.Duration(1*time.Millisecond))
 
-	if c.rendora.c.Server.Enable {
-		
-		c.rendora.metrics.Duration.Observe(elapsed)
-	}
-
 	responseHeaders := make(map[string]string)
 	err = json.Unmarshal(responseReply.Response.Headers, &responseHeaders)
 	if err != nil {
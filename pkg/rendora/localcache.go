@@ -0,0 +1,241 @@
+/*
+Copyright 2018 George Badawi.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rendora
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	localStoreCleanupInterval = 4 * time.Minute
+	//localEntryOverhead roughly accounts for the memory used by an entry besides its key, content and headers
+	localEntryOverhead = 256
+)
+
+//localStore is the cache store embedded in Rendora, it is bounded by the total size and count of its entries and
+//evicts the least recently used entries once any of them is exceeded
+type localStore struct {
+	mtx        sync.Mutex
+	ll         *list.List
+	items      map[string]*list.Element
+	tags       map[string]map[string]struct{}
+	maxBytes   int64
+	maxEntries int
+	bytes      int64
+	evictions  uint64
+}
+
+type localItem struct {
+	cKey    string
+	entry   *CacheEntry
+	size    int64
+	expires time.Time
+	tagKeys []string
+}
+
+//newLocalStore creates a local store, zero maxBytes or maxEntries means no limit
+func newLocalStore(maxBytes int64, maxEntries int) *localStore {
+	ret := &localStore{
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+		tags:       make(map[string]map[string]struct{}),
+		maxBytes:   maxBytes,
+		maxEntries: maxEntries,
+	}
+
+	go func() {
+		for range time.Tick(localStoreCleanupInterval) {
+			ret.deleteExpired()
+		}
+	}()
+
+	return ret
+}
+
+//entrySize estimates the memory used by the entry
+func entrySize(cKey string, entry *CacheEntry) int64 {
+	size := len(cKey) + len(entry.Gzip) + localEntryOverhead
+	if entry.Response != nil {
+		size += len(entry.Response.Content)
+		for k, v := range entry.Response.Headers {
+			size += len(k) + len(v)
+		}
+	}
+	return int64(size)
+}
+
+func (s *localStore) Get(cKey string) (*CacheEntry, bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	elem, ok := s.items[cKey]
+	if !ok {
+		return nil, false, nil
+	}
+
+	item := elem.Value.(*localItem)
+	if time.Now().After(item.expires) {
+		s.remove(elem)
+		return nil, false, nil
+	}
+
+	s.ll.MoveToFront(elem)
+	return item.entry, true, nil
+}
+
+func (s *localStore) Set(cKey string, entry *CacheEntry, ttl time.Duration) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if elem, ok := s.items[cKey]; ok {
+		s.remove(elem)
+	}
+
+	item := &localItem{
+		cKey:    cKey,
+		entry:   entry,
+		size:    entrySize(cKey, entry),
+		expires: time.Now().Add(ttl),
+	}
+	if s.maxBytes > 0 && item.size > s.maxBytes {
+		// it would evict everything else and still not fit
+		return nil
+	}
+
+	s.items[cKey] = s.ll.PushFront(item)
+	s.bytes += item.size
+
+	for (s.maxBytes > 0 && s.bytes > s.maxBytes) || (s.maxEntries > 0 && s.ll.Len() > s.maxEntries) {
+		s.remove(s.ll.Back())
+		s.evictions++
+	}
+	return nil
+}
+
+func (s *localStore) Delete(cKey string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if elem, ok := s.items[cKey]; ok {
+		s.remove(elem)
+	}
+	return nil
+}
+
+func (s *localStore) Scan(prefix string) ([]string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var ret []string
+	now := time.Now()
+	for cKey, elem := range s.items {
+		if strings.HasPrefix(cKey, prefix) && now.Before(elem.Value.(*localItem).expires) {
+			ret = append(ret, cKey)
+		}
+	}
+	return ret, nil
+}
+
+func (s *localStore) Tag(cKey string, tagKeys []string, ttl time.Duration) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// the index lives as long as the entry
+	elem, ok := s.items[cKey]
+	if !ok {
+		return nil
+	}
+	item := elem.Value.(*localItem)
+
+	for _, tagKey := range tagKeys {
+		keys, ok := s.tags[tagKey]
+		if !ok {
+			keys = make(map[string]struct{})
+			s.tags[tagKey] = keys
+		}
+		if _, ok := keys[cKey]; !ok {
+			keys[cKey] = struct{}{}
+			item.tagKeys = append(item.tagKeys, tagKey)
+		}
+	}
+	return nil
+}
+
+func (s *localStore) TaggedKeys(tagKey string) ([]string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var ret []string
+	for cKey := range s.tags[tagKey] {
+		ret = append(ret, cKey)
+	}
+	return ret, nil
+}
+
+func (s *localStore) Untag(tagKey string, cKeys []string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, cKey := range cKeys {
+		s.untag(tagKey, cKey)
+	}
+	return nil
+}
+
+//untag removes the key from the tag index, the caller must hold the lock
+func (s *localStore) untag(tagKey, cKey string) {
+	keys, ok := s.tags[tagKey]
+	if !ok {
+		return
+	}
+	delete(keys, cKey)
+	if len(keys) == 0 {
+		delete(s.tags, tagKey)
+	}
+}
+
+//remove removes the element from the store along with its tag indexes, the caller must hold the lock
+func (s *localStore) remove(elem *list.Element) {
+	item := s.ll.Remove(elem).(*localItem)
+	delete(s.items, item.cKey)
+	s.bytes -= item.size
+	for _, tagKey := range item.tagKeys {
+		s.untag(tagKey, item.cKey)
+	}
+}
+
+//deleteExpired removes the expired entries
+func (s *localStore) deleteExpired() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	now := time.Now()
+	for elem := s.ll.Back(); elem != nil; {
+		prev := elem.Prev()
+		if now.After(elem.Value.(*localItem).expires) {
+			s.remove(elem)
+		}
+		elem = prev
+	}
+}
+
+//stats returns the estimated size of all the entries, their count and the count of evicted entries
+func (s *localStore) stats() (int64, int, uint64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.bytes, s.ll.Len(), s.evictions
+}
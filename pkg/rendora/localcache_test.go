@@ -0,0 +1,177 @@
+/*
+Copyright 2018 George Badawi.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rendora
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+//testLocalEntry returns an entry whose estimated size is size when stored under a one character key
+func testLocalEntry(size int) *CacheEntry {
+	return &CacheEntry{
+		Response: &HeadlessResponse{
+			Status:  200,
+			Content: strings.Repeat("a", size-1-localEntryOverhead),
+		},
+	}
+}
+
+func TestLocalStoreBounds(t *testing.T) {
+	type op struct {
+		get  bool
+		key  string
+		size int
+	}
+	set := func(key string, size int) op { return op{key: key, size: size} }
+	get := func(key string) op { return op{get: true, key: key} }
+
+	tests := []struct {
+		name       string
+		maxBytes   int64
+		maxEntries int
+		ops        []op
+		want       []string
+		evictions  uint64
+	}{
+		{
+			name: "no limits",
+			ops:  []op{set("a", 1000), set("b", 1000), set("c", 1000)},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name:       "entry bound",
+			maxEntries: 2,
+			ops:        []op{set("a", 1000), set("b", 1000), set("c", 1000)},
+			want:       []string{"b", "c"},
+			evictions:  1,
+		},
+		{
+			name:       "entry bound evicting the least recently used",
+			maxEntries: 2,
+			ops:        []op{set("a", 1000), set("b", 1000), get("a"), set("c", 1000)},
+			want:       []string{"a", "c"},
+			evictions:  1,
+		},
+		{
+			name:       "replaced entry",
+			maxEntries: 2,
+			ops:        []op{set("a", 1000), set("b", 1000), set("a", 500)},
+			want:       []string{"a", "b"},
+		},
+		{
+			name:      "byte bound",
+			maxBytes:  2500,
+			ops:       []op{set("a", 1000), set("b", 1000), set("c", 1000)},
+			want:      []string{"b", "c"},
+			evictions: 1,
+		},
+		{
+			name:      "byte bound evicting the least recently used",
+			maxBytes:  2500,
+			ops:       []op{set("a", 1000), set("b", 1000), get("a"), set("c", 1000)},
+			want:      []string{"a", "c"},
+			evictions: 1,
+		},
+		{
+			name:      "large entry evicting multiple entries",
+			maxBytes:  2500,
+			ops:       []op{set("a", 1000), set("b", 1000), set("c", 2000)},
+			want:      []string{"c"},
+			evictions: 2,
+		},
+		{
+			name:     "entry exactly at the byte bound",
+			maxBytes: 2000,
+			ops:      []op{set("a", 1000), set("b", 1000)},
+			want:     []string{"a", "b"},
+		},
+		{
+			name:     "entry larger than the byte bound",
+			maxBytes: 2500,
+			ops:      []op{set("a", 1000), set("b", 3000)},
+			want:     []string{"a"},
+		},
+		{
+			name:       "both bounds",
+			maxBytes:   2500,
+			maxEntries: 3,
+			ops:        []op{set("a", 300), set("b", 300), set("c", 300), set("d", 300), set("e", 2000)},
+			want:       []string{"d", "e"},
+			evictions:  3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newLocalStore(tt.maxBytes, tt.maxEntries)
+			sizes := make(map[string]int)
+			for _, o := range tt.ops {
+				if o.get {
+					if _, ok, _ := s.Get(o.key); !ok {
+						t.Fatalf("Get(%q) missed", o.key)
+					}
+					continue
+				}
+				if err := s.Set(o.key, testLocalEntry(o.size), time.Minute); err != nil {
+					t.Fatal(err)
+				}
+				sizes[o.key] = o.size
+			}
+
+			got, _ := s.Scan("")
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("keys = %v, want %v", got, tt.want)
+			}
+
+			var wantBytes int64
+			for _, key := range tt.want {
+				wantBytes += int64(sizes[key])
+			}
+			bytes, entries, evictions := s.stats()
+			if bytes != wantBytes || entries != len(tt.want) || evictions != tt.evictions {
+				t.Errorf("stats() = %d, %d, %d, want %d, %d, %d", bytes, entries, evictions, wantBytes, len(tt.want), tt.evictions)
+			}
+		})
+	}
+}
+
+func TestLocalStoreEvictionUntags(t *testing.T) {
+	s := newLocalStore(0, 1)
+	s.Set("a", testLocalEntry(1000), time.Minute)
+	s.Tag("a", []string{"tag"}, time.Minute)
+	s.Set("b", testLocalEntry(1000), time.Minute)
+
+	if keys, _ := s.TaggedKeys("tag"); len(keys) != 0 {
+		t.Errorf("TaggedKeys() = %v after eviction, want none", keys)
+	}
+}
+
+func TestLocalStoreExpiry(t *testing.T) {
+	s := newLocalStore(0, 0)
+	s.Set("a", testLocalEntry(1000), -time.Second)
+	s.Set("b", testLocalEntry(1000), time.Minute)
+
+	if _, ok, _ := s.Get("a"); ok {
+		t.Error("Get() returned an expired entry")
+	}
+	s.deleteExpired()
+	if bytes, entries, _ := s.stats(); bytes != 1000 || entries != 1 {
+		t.Errorf("stats() = %d, %d after removing the expired entries, want 1000, 1", bytes, entries)
+	}
+}
@@ -17,10 +17,20 @@ import "github.com/prometheus/client_golang/prometheus"
 
 //metrics provides various Prometheus metrics
 type metrics struct {
-	Duration       prometheus.Histogram
-	CountTotal     prometheus.Counter
-	CountSSR       prometheus.Counter
-	CountSSRCached prometheus.Counter
+	Duration             prometheus.Histogram
+	CountTotal           prometheus.Counter
+	CountSSR             prometheus.Counter
+	CountSSRCached       prometheus.Counter
+	CountSSRCoalesced    prometheus.Counter
+	CountSSRStale        prometheus.Counter
+	CountRefreshed       prometheus.Counter
+	CountCrawlerRejected prometheus.Counter
+	CountDenied          prometheus.Counter
+	PoolBusy             prometheus.GaugeFunc
+	PoolIdle             prometheus.GaugeFunc
+	CacheBytes           prometheus.GaugeFunc
+	CacheEntries         prometheus.GaugeFunc
+	CacheEvictions       prometheus.CounterFunc
 }
 
 func (R *Rendora) initPrometheus() {
@@ -40,6 +50,31 @@ func (R *Rendora) initPrometheus() {
 		Help: "Cached SSR Requests",
 	})
 
+	ret.CountSSRCoalesced = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rendora_requests_ssr_coalesced",
+		Help: "SSR Requests served by a concurrent render of the same page",
+	})
+
+	ret.CountSSRStale = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rendora_requests_ssr_stale",
+		Help: "SSR Requests served by stale cached responses",
+	})
+
+	ret.CountRefreshed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rendora_cache_refreshed",
+		Help: "Popular pages re-rendered in the background before their cache entries expire",
+	})
+
+	ret.CountCrawlerRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rendora_requests_crawler_rejected",
+		Help: "Requests claiming to come from known crawlers that failed the DNS verification",
+	})
+
+	ret.CountDenied = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rendora_requests_denied",
+		Help: "Requests denied by the filter rules",
+	})
+
 	ret.Duration = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Name:    "rendora_latency_ssr",
 		Help:    "SSR Latency",
@@ -49,5 +84,62 @@ func (R *Rendora) initPrometheus() {
 	prometheus.MustRegister(ret.CountTotal)
 	prometheus.MustRegister(ret.CountSSR)
 	prometheus.MustRegister(ret.Duration)
+	prometheus.MustRegister(ret.CountSSRCoalesced)
+	prometheus.MustRegister(ret.CountSSRStale)
+	prometheus.MustRegister(ret.CountRefreshed)
+	prometheus.MustRegister(ret.CountCrawlerRejected)
+	prometheus.MustRegister(ret.CountDenied)
+
+	if R.h != nil {
+		ret.PoolBusy = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "rendora_headless_pool_busy",
+			Help: "Headless Chrome tabs currently rendering",
+		}, func() float64 {
+			busy, _ := R.h.occupancy()
+			return float64(busy)
+		})
+
+		ret.PoolIdle = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "rendora_headless_pool_idle",
+			Help: "Idle headless Chrome tabs",
+		}, func() float64 {
+			_, idle := R.h.occupancy()
+			return float64(idle)
+		})
+
+		prometheus.MustRegister(ret.PoolBusy)
+		prometheus.MustRegister(ret.PoolIdle)
+	}
+
+	if local := R.cache.local; local != nil {
+		ret.CacheBytes = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "rendora_cache_local_bytes",
+			Help: "Estimated size of the pages in the local cache",
+		}, func() float64 {
+			bytes, _, _ := local.stats()
+			return float64(bytes)
+		})
+
+		ret.CacheEntries = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "rendora_cache_local_entries",
+			Help: "Pages in the local cache",
+		}, func() float64 {
+			_, entries, _ := local.stats()
+			return float64(entries)
+		})
+
+		ret.CacheEvictions = prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "rendora_cache_local_evictions_total",
+			Help: "Pages evicted from the local cache to stay within its limits",
+		}, func() float64 {
+			_, _, evictions := local.stats()
+			return float64(evictions)
+		})
+
+		prometheus.MustRegister(ret.CacheBytes)
+		prometheus.MustRegister(ret.CacheEntries)
+		prometheus.MustRegister(ret.CacheEvictions)
+	}
+
 	R.metrics = ret
 }
@@ -0,0 +1,149 @@
+/*
+Copyright 2018 George Badawi.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rendora
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+//redisTLSConfig returns the TLS configuration of the Redis connections, it returns nil if TLS is disabled
+func (R *Rendora) redisTLSConfig() (*tls.Config, error) {
+	tlsConfig := &R.c.Cache.Redis.TLS
+	if !tlsConfig.Enable {
+		return nil, nil
+	}
+
+	ret := &tls.Config{
+		ServerName:         tlsConfig.ServerName,
+		InsecureSkipVerify: tlsConfig.InsecureSkipVerify,
+	}
+
+	if tlsConfig.CAFile != "" {
+		ca, err := ioutil.ReadFile(tlsConfig.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cache.redis.tls.caFile: %v", err)
+		}
+		ret.RootCAs = x509.NewCertPool()
+		if !ret.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("cache.redis.tls.caFile: no certificates found in %s", tlsConfig.CAFile)
+		}
+	}
+
+	if tlsConfig.CertFile != "" || tlsConfig.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(tlsConfig.CertFile, tlsConfig.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cache.redis.tls: loading the client certificate failed: %v", err)
+		}
+		ret.Certificates = []tls.Certificate{cert}
+	}
+
+	return ret, nil
+}
+
+//newRedisClient returns a client of the configured Redis server, Sentinel-managed primary or cluster
+func (R *Rendora) newRedisClient() (redis.UniversalClient, error) {
+	redisConfig := &R.c.Cache.Redis
+
+	if redisConfig.Sentinel.MasterName != "" && len(redisConfig.Cluster.Addresses) > 0 {
+		return nil, errors.New("cache.redis: sentinel and cluster can't be used together")
+	}
+	if len(redisConfig.Cluster.Addresses) > 0 && redisConfig.DB != 0 {
+		return nil, errors.New("cache.redis: db must be 0 in cluster mode")
+	}
+
+	tlsConfig, err := R.redisTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	password := redisConfig.Password
+	db := redisConfig.DB
+	var onConnect func(*redis.Conn) error
+	if redisConfig.Username != "" {
+		// the Redis client only supports password authentication, ACL users are authenticated once connected and
+		// the database is selected afterwards since it requires authentication
+		password, db = "", 0
+		onConnect = func(cn *redis.Conn) error {
+			if err := cn.Process(redis.NewStatusCmd("auth", redisConfig.Username, redisConfig.Password)); err != nil {
+				return err
+			}
+			if redisConfig.DB != 0 {
+				return cn.Select(redisConfig.DB).Err()
+			}
+			return nil
+		}
+	}
+
+	ms := func(v uint32) time.Duration {
+		return time.Duration(v) * time.Millisecond
+	}
+
+	switch {
+	case redisConfig.Sentinel.MasterName != "":
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    redisConfig.Sentinel.MasterName,
+			SentinelAddrs: redisConfig.Sentinel.Addresses,
+			OnConnect:     onConnect,
+			Password:      password,
+			DB:            db,
+			MaxRetries:    redisConfig.MaxRetries,
+			DialTimeout:   ms(redisConfig.DialTimeout),
+			ReadTimeout:   ms(redisConfig.ReadTimeout),
+			WriteTimeout:  ms(redisConfig.WriteTimeout),
+			PoolSize:      redisConfig.Pool.Size,
+			MinIdleConns:  redisConfig.Pool.MinIdle,
+			PoolTimeout:   ms(redisConfig.Pool.Timeout),
+			IdleTimeout:   ms(redisConfig.Pool.IdleTimeout),
+			TLSConfig:     tlsConfig,
+		}), nil
+	case len(redisConfig.Cluster.Addresses) > 0:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        redisConfig.Cluster.Addresses,
+			OnConnect:    onConnect,
+			Password:     password,
+			MaxRetries:   redisConfig.MaxRetries,
+			DialTimeout:  ms(redisConfig.DialTimeout),
+			ReadTimeout:  ms(redisConfig.ReadTimeout),
+			WriteTimeout: ms(redisConfig.WriteTimeout),
+			PoolSize:     redisConfig.Pool.Size,
+			MinIdleConns: redisConfig.Pool.MinIdle,
+			PoolTimeout:  ms(redisConfig.Pool.Timeout),
+			IdleTimeout:  ms(redisConfig.Pool.IdleTimeout),
+			TLSConfig:    tlsConfig,
+		}), nil
+	default:
+		return redis.NewClient(&redis.Options{
+			Addr:         redisConfig.Address,
+			OnConnect:    onConnect,
+			Password:     password,
+			DB:           db,
+			MaxRetries:   redisConfig.MaxRetries,
+			DialTimeout:  ms(redisConfig.DialTimeout),
+			ReadTimeout:  ms(redisConfig.ReadTimeout),
+			WriteTimeout: ms(redisConfig.WriteTimeout),
+			PoolSize:     redisConfig.Pool.Size,
+			MinIdleConns: redisConfig.Pool.MinIdle,
+			PoolTimeout:  ms(redisConfig.Pool.Timeout),
+			IdleTimeout:  ms(redisConfig.Pool.IdleTimeout),
+			TLSConfig:    tlsConfig,
+		}), nil
+	}
+}
@@ -0,0 +1,484 @@
+/*
+Copyright 2018 George Badawi.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rendora
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//fakeRedis is a Redis server stand-in implementing the few commands used by Rendora, it requires AUTH with the
+//username and password if password is set and reports slots to CLUSTER SLOTS
+type fakeRedis struct {
+	t        *testing.T
+	ln       net.Listener
+	username string
+	password string
+
+	mtx      sync.Mutex
+	slots    []fakeRedisSlots
+	strings  map[string]string
+	sets     map[string]map[string]bool
+	expiries map[string]time.Time
+	auths    [][]string
+	selected []int
+}
+
+//fakeRedisSlots is a range of cluster slots served by the stand-in at addr
+type fakeRedisSlots struct {
+	start, end int
+	addr       string
+}
+
+func newFakeRedis(t *testing.T, username, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeRedis{
+		t:        t,
+		ln:       ln,
+		username: username,
+		password: password,
+		strings:  make(map[string]string),
+		sets:     make(map[string]map[string]bool),
+		expiries: make(map[string]time.Time),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeRedis) close() {
+	s.ln.Close()
+}
+
+func (s *fakeRedis) set(key, value string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.strings[key] = value
+}
+
+func (s *fakeRedis) setSlots(slots []fakeRedisSlots) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.slots = slots
+}
+
+//globMatch checks whether str matches the Redis glob pattern, unlike path.Match "*" also matches slashes
+func globMatch(pattern, str string) bool {
+	if pattern == "" {
+		return str == ""
+	}
+
+	switch pattern[0] {
+	case '*':
+		for i := 0; i <= len(str); i++ {
+			if globMatch(pattern[1:], str[i:]) {
+				return true
+			}
+		}
+		return false
+	case '?':
+		return str != "" && globMatch(pattern[1:], str[1:])
+	case '\\':
+		if len(pattern) > 1 {
+			pattern = pattern[1:]
+		}
+	}
+	return str != "" && pattern[0] == str[0] && globMatch(pattern[1:], str[1:])
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authenticated := s.password == ""
+
+	for {
+		args, err := readRESPCommand(r)
+		if err != nil {
+			return
+		}
+
+		name := strings.ToUpper(args[0])
+		if name == "AUTH" {
+			s.mtx.Lock()
+			s.auths = append(s.auths, args[1:])
+			s.mtx.Unlock()
+			authenticated = len(args) == 3 && args[1] == s.username && args[2] == s.password
+			if authenticated {
+				io.WriteString(conn, "+OK\r\n")
+			} else {
+				io.WriteString(conn, "-WRONGPASS invalid username-password pair\r\n")
+			}
+			continue
+		}
+		if !authenticated {
+			io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+
+		io.WriteString(conn, s.exec(name, args[1:]))
+	}
+}
+
+//exec runs the command and returns its RESP encoded reply
+func (s *fakeRedis) exec(name string, args []string) string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for key, expiresAt := range s.expiries {
+		if time.Now().After(expiresAt) {
+			delete(s.strings, key)
+			delete(s.sets, key)
+			delete(s.expiries, key)
+		}
+	}
+
+	switch name {
+	case "PING":
+		return "+PONG\r\n"
+	case "COMMAND":
+		// the cluster client falls back to the first argument as the key
+		return "*0\r\n"
+	case "SELECT":
+		db, _ := strconv.Atoi(args[0])
+		s.selected = append(s.selected, db)
+		return "+OK\r\n"
+	case "GET":
+		if v, ok := s.strings[args[0]]; ok {
+			return respBulk(v)
+		}
+		return "$-1\r\n"
+	case "SET":
+		s.strings[args[0]] = args[1]
+		delete(s.expiries, args[0])
+		for i := 2; i+1 < len(args); i++ {
+			if strings.ToUpper(args[i]) == "PX" {
+				ms, _ := strconv.Atoi(args[i+1])
+				s.expiries[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			}
+		}
+		return "+OK\r\n"
+	case "DEL":
+		n := 0
+		for _, key := range args {
+			_, isString := s.strings[key]
+			_, isSet := s.sets[key]
+			if isString || isSet {
+				n++
+			}
+			delete(s.strings, key)
+			delete(s.sets, key)
+			delete(s.expiries, key)
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "SADD":
+		set := s.sets[args[0]]
+		if set == nil {
+			set = make(map[string]bool)
+			s.sets[args[0]] = set
+		}
+		n := 0
+		for _, member := range args[1:] {
+			if !set[member] {
+				set[member] = true
+				n++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "SREM":
+		n := 0
+		for _, member := range args[1:] {
+			if s.sets[args[0]][member] {
+				delete(s.sets[args[0]], member)
+				n++
+			}
+		}
+		if len(s.sets[args[0]]) == 0 {
+			delete(s.sets, args[0])
+			delete(s.expiries, args[0])
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "SMEMBERS":
+		var members []string
+		for member := range s.sets[args[0]] {
+			members = append(members, member)
+		}
+		return respArray(members)
+	case "PTTL":
+		_, isString := s.strings[args[0]]
+		_, isSet := s.sets[args[0]]
+		expiresAt, expires := s.expiries[args[0]]
+		switch {
+		case !isString && !isSet:
+			return ":-2\r\n"
+		case !expires:
+			return ":-1\r\n"
+		}
+		return fmt.Sprintf(":%d\r\n", time.Until(expiresAt)/time.Millisecond)
+	case "PEXPIRE":
+		ms, _ := strconv.Atoi(args[1])
+		s.expiries[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	case "SCAN":
+		// all the keys are returned at once
+		match := "*"
+		for i := 1; i+1 < len(args); i++ {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				match = args[i+1]
+			}
+		}
+		var keys []string
+		for key := range s.strings {
+			if globMatch(match, key) {
+				keys = append(keys, key)
+			}
+		}
+		return "*2\r\n" + respBulk("0") + respArray(keys)
+	case "CLUSTER":
+		if len(args) == 0 || strings.ToUpper(args[0]) != "SLOTS" || len(s.slots) == 0 {
+			return "-ERR This instance has cluster support disabled\r\n"
+		}
+		ret := fmt.Sprintf("*%d\r\n", len(s.slots))
+		for _, slots := range s.slots {
+			host, port, _ := net.SplitHostPort(slots.addr)
+			ret += fmt.Sprintf("*3\r\n:%d\r\n:%d\r\n*3\r\n%s:%s\r\n%s", slots.start, slots.end, respBulk(host), port,
+				respBulk(slots.addr))
+		}
+		return ret
+	}
+
+	s.t.Errorf("unexpected Redis command %s %v", name, args)
+	return "-ERR unknown command\r\n"
+}
+
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || line[0] != '*' {
+		return nil, fmt.Errorf("unexpected command %q", line)
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func respBulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func respArray(items []string) string {
+	ret := fmt.Sprintf("*%d\r\n", len(items))
+	for _, item := range items {
+		ret += respBulk(item)
+	}
+	return ret
+}
+
+func newTestRedisStore(t *testing.T, R *Rendora) *redisStore {
+	client, err := R.newRedisClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &redisStore{
+		client: client,
+	}
+}
+
+func TestRedisACLAuthentication(t *testing.T) {
+	server := newFakeRedis(t, "rendora", "s3cret")
+	defer server.close()
+
+	tests := []struct {
+		name     string
+		password string
+		db       int
+		ok       bool
+	}{
+		{"right password", "s3cret", 0, true},
+		{"right password with db", "s3cret", 3, true},
+		{"wrong password", "wrong", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server.mtx.Lock()
+			server.auths, server.selected = nil, nil
+			server.mtx.Unlock()
+
+			R := &Rendora{c: &rendoraConfig{}}
+			R.c.Cache.Redis.Address = server.addr()
+			R.c.Cache.Redis.Username = "rendora"
+			R.c.Cache.Redis.Password = tt.password
+			R.c.Cache.Redis.DB = tt.db
+			s := newTestRedisStore(t, R)
+			defer s.client.Close()
+
+			_, _, err := s.Get("key")
+			if (err == nil) != tt.ok {
+				t.Fatalf("Get() error = %v, want success %v", err, tt.ok)
+			}
+
+			server.mtx.Lock()
+			defer server.mtx.Unlock()
+			if len(server.auths) == 0 || !reflect.DeepEqual(server.auths[0], []string{"rendora", tt.password}) {
+				t.Errorf("AUTH arguments = %v, want [rendora %s]", server.auths, tt.password)
+			}
+			if tt.ok && tt.db != 0 && (len(server.selected) == 0 || server.selected[0] != tt.db) {
+				t.Errorf("selected databases = %v, want %d", server.selected, tt.db)
+			}
+			if tt.db == 0 && len(server.selected) != 0 {
+				t.Errorf("selected databases = %v, want none", server.selected)
+			}
+		})
+	}
+}
+
+func TestRedisClusterScan(t *testing.T) {
+	first := newFakeRedis(t, "", "")
+	defer first.close()
+	second := newFakeRedis(t, "", "")
+	defer second.close()
+
+	slots := []fakeRedisSlots{
+		{0, 8191, first.addr()},
+		{8192, 16383, second.addr()},
+	}
+	first.setSlots(slots)
+	second.setSlots(slots)
+
+	first.set("rendora:/a", "a")
+	first.set("other:/a", "a")
+	second.set("rendora:/b", "b")
+	second.set("rendora:/c*", "c")
+
+	R := &Rendora{c: &rendoraConfig{}}
+	R.c.Cache.Redis.Cluster.Addresses = []string{first.addr()}
+	s := newTestRedisStore(t, R)
+	defer s.client.Close()
+
+	keys, err := s.Scan("rendora:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	want := []string{"rendora:/a", "rendora:/b", "rendora:/c*"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("Scan() = %v, want %v", keys, want)
+	}
+
+	// glob characters in the prefix are matched literally
+	keys, err = s.Scan("rendora:/c*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"rendora:/c*"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("Scan() = %v, want %v", keys, want)
+	}
+}
+
+func TestRedisTags(t *testing.T) {
+	server := newFakeRedis(t, "", "")
+	defer server.close()
+
+	R := &Rendora{c: &rendoraConfig{}}
+	R.c.Cache.Redis.Address = server.addr()
+	s := newTestRedisStore(t, R)
+	defer s.client.Close()
+
+	if err := s.Tag("rendora:/a", []string{"tag:x", "tag:y"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Tag("rendora:/b", []string{"tag:x"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := s.TaggedKeys("tag:x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if want := []string{"rendora:/a", "rendora:/b"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("TaggedKeys(tag:x) = %v, want %v", keys, want)
+	}
+
+	// the index must outlive its longest-lived key
+	pttl, err := s.client.PTTL("tag:x").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pttl <= time.Minute {
+		t.Errorf("PTTL(tag:x) = %v, want more than a minute", pttl)
+	}
+
+	if err = s.Untag("tag:x", []string{"rendora:/a"}); err != nil {
+		t.Fatal(err)
+	}
+	keys, err = s.TaggedKeys("tag:x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"rendora:/b"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("TaggedKeys(tag:x) after Untag = %v, want %v", keys, want)
+	}
+
+	keys, err = s.TaggedKeys("tag:y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"rendora:/a"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("TaggedKeys(tag:y) = %v, want %v", keys, want)
+	}
+}
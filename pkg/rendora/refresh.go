@@ -0,0 +1,217 @@
+/*
+Copyright 2018 George Badawi.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rendora
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	refreshInterval      = 10 * time.Second
+	refreshDecayInterval = 5 * time.Minute
+	refreshMinTracked    = 10000
+)
+
+//refreshHit tracks how often the page with the key cKey is requested and when its cache entry expires
+type refreshHit struct {
+	cKey      string
+	uri       string
+	variant   pageVariant
+	hits      uint64
+	expiresAt time.Time
+}
+
+//refreshState holds the hit counts of the requested pages and the background render budget of the current minute
+type refreshState struct {
+	mtx         sync.Mutex
+	hits        map[string]*refreshHit
+	maxTracked  int
+	lastDecay   time.Time
+	budgetStart time.Time
+	budgetUsed  uint32
+}
+
+//startRefresh starts re-rendering the most requested pages shortly before their cache entries expire
+func (R *Rendora) startRefresh() {
+	maxTracked := 10 * int(R.c.Cache.Refresh.TopN)
+	if maxTracked < refreshMinTracked {
+		maxTracked = refreshMinTracked
+	}
+
+	R.refresh = &refreshState{
+		hits:       make(map[string]*refreshHit),
+		maxTracked: maxTracked,
+		lastDecay:  time.Now(),
+	}
+
+	go func() {
+		for range time.Tick(refreshInterval) {
+			R.refreshHottest()
+		}
+	}()
+}
+
+//resetRefresh stops tracking all the pages, e.g. when the cache version changes since their keys are no longer used
+func (R *Rendora) resetRefresh() {
+	s := R.refresh
+	if s == nil {
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.hits = make(map[string]*refreshHit)
+}
+
+//trackHit counts a request of the page with the key cKey, expiresAt is zero if the page isn't cached yet
+func (R *Rendora) trackHit(cKey, uri string, variant pageVariant, expiresAt time.Time) {
+	s := R.refresh
+	if s == nil {
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	hit, ok := s.hits[cKey]
+	if !ok {
+		// new pages are tracked again once the least requested ones are dropped
+		if len(s.hits) >= s.maxTracked {
+			return
+		}
+		hit = &refreshHit{
+			cKey:    cKey,
+			uri:     uri,
+			variant: variant,
+		}
+		s.hits[cKey] = hit
+	}
+
+	hit.hits++
+	if !expiresAt.IsZero() {
+		hit.expiresAt = expiresAt
+	}
+}
+
+//trackRender updates the expiration time of the tracked page after rendering it, pages that can't be cached aren't tracked
+func (R *Rendora) trackRender(cKey string, expiresAt time.Time, cacheable bool) {
+	s := R.refresh
+	if s == nil {
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	hit, ok := s.hits[cKey]
+	if !ok {
+		return
+	}
+	if !cacheable {
+		delete(s.hits, cKey)
+		return
+	}
+	hit.expiresAt = expiresAt
+}
+
+//refreshCandidates returns the keys and uris of the most requested pages expiring soon, ordered by their hit counts
+func (R *Rendora) refreshCandidates() []refreshHit {
+	s := R.refresh
+	refreshConfig := &R.c.Cache.Refresh
+	keyPrefix := R.cacheKeyPrefix()
+	now := time.Now()
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	hottest := make([]*refreshHit, 0, len(s.hits))
+	for cKey, hit := range s.hits {
+		// pages requested right before the cache version changed may still be tracked with the previous version
+		if !strings.HasPrefix(cKey, keyPrefix) {
+			delete(s.hits, cKey)
+			continue
+		}
+		hottest = append(hottest, hit)
+	}
+	sort.Slice(hottest, func(i, j int) bool {
+		return hottest[i].hits > hottest[j].hits
+	})
+
+	// the hit counts are halved periodically so that pages that are no longer requested stop being refreshed,
+	// pages beyond the tracking limit are dropped to make room for new ones
+	if now.Sub(s.lastDecay) >= refreshDecayInterval {
+		s.lastDecay = now
+		for i, hit := range hottest {
+			hit.hits /= 2
+			if hit.hits == 0 || i >= s.maxTracked/2 {
+				delete(s.hits, hit.cKey)
+			}
+		}
+	}
+
+	if len(hottest) > int(refreshConfig.TopN) {
+		hottest = hottest[:refreshConfig.TopN]
+	}
+
+	before := time.Duration(refreshConfig.Before) * time.Second
+	var ret []refreshHit
+	for _, hit := range hottest {
+		if hit.hits == 0 || hit.expiresAt.IsZero() || hit.expiresAt.Sub(now) > before {
+			continue
+		}
+		ret = append(ret, *hit)
+	}
+	return ret
+}
+
+//takeRefreshBudget checks whether another background render is allowed in the current minute
+func (R *Rendora) takeRefreshBudget() bool {
+	s := R.refresh
+	now := time.Now()
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if now.Sub(s.budgetStart) >= time.Minute {
+		s.budgetStart = now
+		s.budgetUsed = 0
+	}
+	if s.budgetUsed >= R.c.Cache.Refresh.Budget {
+		return false
+	}
+	s.budgetUsed++
+	return true
+}
+
+//refreshHottest re-renders the candidates one at a time within the render budget
+func (R *Rendora) refreshHottest() {
+	for _, hit := range R.refreshCandidates() {
+		if !R.takeRefreshBudget() {
+			return
+		}
+
+		if _, err := R.renderShared(hit.cKey, hit.uri, hit.variant); err != nil {
+			log.Printf("Refreshing %s failed: %v\n", hit.uri, err)
+			continue
+		}
+
+		if R.c.Server.Enable {
+			R.metrics.CountRefreshed.Inc()
+		}
+	}
+}
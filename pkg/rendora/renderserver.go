@@ -0,0 +1,92 @@
+/*
+Copyright 2018 George Badawi.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rendora
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//renderServerPages renders the requested url using the local headless Chrome instance and returns HeadlessResponse
+func (R *Rendora) renderServerPages(c *gin.Context) {
+	var args reqBody
+	if err := c.ShouldBindJSON(&args); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if args.URL == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url is required"})
+		return
+	}
+
+	resp, err := R.h.getResponse(args.URL, args.Mobile)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusOK)
+
+	c.Writer.Header()["Content-Type"] = []string{"application/json; charset=utf-8"}
+
+	enc := json.NewEncoder(c.Writer)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(resp); err != nil {
+		panic(err)
+	}
+}
+
+func (R *Rendora) initRenderServer() *http.Server {
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		token := c.Request.Header.Get("X-Rendora-Auth")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(R.c.Headless.AuthToken)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "wrong authentication key",
+			})
+		}
+	})
+
+	r.POST("/pages", R.renderServerPages)
+
+	srv := &http.Server{
+		Addr:         fmt.Sprintf("%s:%d", R.c.RenderServer.Listen.Address, R.c.RenderServer.Listen.Port),
+		Handler:      r,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: time.Duration(R.c.Headless.Timeout)*time.Second + 5*time.Second,
+	}
+
+	return srv
+}
+
+//RunRenderServer starts the render server used by Rendora instances running in the external headless mode
+func (R *Rendora) RunRenderServer() error {
+
+	if R.c.Debug == false {
+		gin.SetMode(gin.ReleaseMode)
+	}
+
+	// the render server renders any url it is sent so it must never accept unauthenticated requests
+	if R.c.Headless.AuthToken == "" {
+		return errors.New("headless.authToken is required to run the render server")
+	}
+
+	return R.initRenderServer().ListenAndServe()
+}
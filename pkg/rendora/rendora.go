@@ -14,9 +14,13 @@ limitations under the License.
 package rendora
 
 import (
+	"crypto/subtle"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -37,17 +41,40 @@ func (R *Rendora) getProxy(c *gin.Context) {
 
 func (R *Rendora) middleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if c.Request.Method != http.MethodGet {
+		// the requests of the headless Chrome tabs rendering pages are proxied before the filter rules are checked,
+		// otherwise deny rules matching them (e.g. by path or by the user agent of headless Chrome) would break rendering
+		if c.Request.Header.Get("X-Rendora-Type") == "RENDER" {
 			R.getProxy(c)
 			return
 		}
 
-		if c.Request.Header.Get("X-Rendora-Type") == "RENDER" {
+		action := R.filterRuleAction(c)
+		if action == "deny" {
+			c.AbortWithStatus(http.StatusForbidden)
+			if R.c.Server.Enable {
+				R.metrics.CountDenied.Inc()
+				R.metrics.CountTotal.Inc()
+			}
+			return
+		}
+
+		if c.Request.Method != http.MethodGet {
 			R.getProxy(c)
 			return
 		}
 
-		if R.isWhitelisted(c) {
+		var whitelisted bool
+		switch action {
+		case "render":
+			// static paths and unverified crawlers are never SSR'ed even by the filter rules
+			whitelisted = !R.isStaticPath(c.Request.RequestURI) && R.isVerifiedCrawler(c)
+		case "proxy":
+			whitelisted = false
+		default:
+			whitelisted = R.isWhitelisted(c)
+		}
+
+		if whitelisted {
 			R.getSSR(c)
 		} else {
 			R.getProxy(c)
@@ -77,7 +104,8 @@ func (R *Rendora) initRendoraServer() *http.Server {
 	r := gin.New()
 	r.Use(func(c *gin.Context) {
 		if R.c.Server.Auth.Enable {
-			if c.Request.Header.Get(R.c.Server.Auth.Name) != R.c.Server.Auth.Value {
+			value := c.Request.Header.Get(R.c.Server.Auth.Name)
+			if subtle.ConstantTimeCompare([]byte(value), []byte(R.c.Server.Auth.Value)) != 1 {
 				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
 					"error": "wrong authentication key",
 				})
@@ -89,6 +117,22 @@ func (R *Rendora) initRendoraServer() *http.Server {
 
 	r.POST("/render", R.apiRender)
 
+	r.GET("/cache/keys", R.apiCacheKeys)
+	r.GET("/cache/version", R.apiCacheVersion)
+	r.GET("/warmup", R.apiWarmupStatus)
+
+	// anyone reaching the API server could flush or poison the cache, dump it or start warmups, so these endpoints
+	// require authentication
+	if R.c.Server.Auth.Enable {
+		r.POST("/cache/purge", R.apiCachePurge)
+		r.POST("/cache/version", R.apiCacheVersionSet)
+		r.GET("/cache/export", R.apiCacheExport)
+		r.POST("/cache/import", R.apiCacheImport)
+		r.POST("/warmup", R.apiWarmupStart)
+	} else {
+		log.Println("The API endpoints changing or exporting the cache and starting warmups are disabled since server.auth isn't enabled")
+	}
+
 	srv := &http.Server{
 		Addr:         fmt.Sprintf("%s:%d", R.c.Server.Listen.Address, R.c.Server.Listen.Port),
 		Handler:      r,
@@ -99,6 +143,79 @@ func (R *Rendora) initRendoraServer() *http.Server {
 	return srv
 }
 
+//connListener keeps track of the accepted connections by their remote address so that handlers can lift the read and
+//write timeouts of the server for their own connection
+type connListener struct {
+	net.Listener
+	mtx   sync.Mutex
+	conns map[string]net.Conn
+}
+
+//trackedConn removes itself from the listener's connections once closed
+type trackedConn struct {
+	net.Conn
+	l    *connListener
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.l.mtx.Lock()
+		delete(c.l.conns, c.RemoteAddr().String())
+		c.l.mtx.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+func newConnListener(l net.Listener) *connListener {
+	return &connListener{
+		Listener: l,
+		conns:    make(map[string]net.Conn),
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	// the same as http.ListenAndServe does
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(3 * time.Minute)
+	}
+
+	ret := &trackedConn{
+		Conn: conn,
+		l:    l,
+	}
+	l.mtx.Lock()
+	l.conns[conn.RemoteAddr().String()] = ret
+	l.mtx.Unlock()
+	return ret, nil
+}
+
+//clearDeadlines removes the read and write deadlines of the connection, the server sets them again for its next request
+func (l *connListener) clearDeadlines(remoteAddr string) {
+	l.mtx.Lock()
+	conn := l.conns[remoteAddr]
+	l.mtx.Unlock()
+
+	if conn != nil {
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+//liftDeadlines removes the read and write timeouts of the API server for the current request, it must only be used by
+//endpoints streaming large bodies (e.g. cache archives) since they run after the authentication, the timeouts are
+//kept for unauthenticated clients
+func (R *Rendora) liftDeadlines(c *gin.Context) {
+	if R.apiConns != nil && R.c.Server.Auth.Enable {
+		R.apiConns.clearDeadlines(c.Request.RemoteAddr)
+	}
+}
+
 var (
 	g errgroup.Group
 )
@@ -115,8 +232,14 @@ func (R *Rendora) Run() error {
 	})
 
 	if R.c.Server.Enable {
+		srv := R.initRendoraServer()
+		l, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			return err
+		}
+		R.apiConns = newConnListener(l)
 		g.Go(func() error {
-			return R.initRendoraServer().ListenAndServe()
+			return srv.Serve(R.apiConns)
 		})
 	}
 
@@ -128,10 +251,20 @@ func (R *Rendora) Run() error {
 
 //New creates a new Rendora instance
 func New(cfgFile string) (*Rendora, error) {
+	return newRendora(cfgFile, false)
+}
+
+//NewRenderServer creates a new Rendora instance that renders pages for other Rendora instances running in the external headless mode
+func NewRenderServer(cfgFile string) (*Rendora, error) {
+	return newRendora(cfgFile, true)
+}
+
+func newRendora(cfgFile string, renderServer bool) (*Rendora, error) {
 	rendora := &Rendora{
-		c:       &rendoraConfig{},
-		metrics: &metrics{},
-		cfgFile: cfgFile,
+		c:            &rendoraConfig{},
+		metrics:      &metrics{},
+		cfgFile:      cfgFile,
+		renderServer: renderServer,
 	}
 	err := rendora.initConfig()
 	if err != nil {
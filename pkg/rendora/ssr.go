@@ -14,8 +14,16 @@ limitations under the License.
 package rendora
 
 import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	jsoniter "github.com/json-iterator/go"
@@ -27,7 +35,8 @@ import (
 var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
 type reqBody struct {
-	URL string `json:"url"`
+	URL    string `json:"url"`
+	Mobile bool   `json:"mobile,omitempty"`
 }
 
 //HeadlessResponse contains the status code, DOM content and headers of the response coming from the headless chrome instance
@@ -36,13 +45,49 @@ type HeadlessResponse struct {
 	Content string            `json:"content"`
 	Headers map[string]string `json:"headers"`
 	Latency float64           `json:"latency"`
+	//gzipped is the gzip-compressed Content, Content may be empty if the response comes from the cache until decompress is called
+	gzipped []byte
 }
 
-/*
-func getHeadlessExternal(uri string) (*HeadlessResponse, error) {
-	client := &http.Client{}
+//compress sets the gzip-compressed content of the response
+func (h *HeadlessResponse) compress() error {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	if _, err := io.WriteString(w, h.Content); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	h.gzipped = buf.Bytes()
+	return nil
+}
+
+//decompress sets the content of cached responses that are only available compressed
+func (h *HeadlessResponse) decompress() error {
+	if h.gzipped == nil || h.Content != "" {
+		return nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(h.gzipped))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	h.Content = string(content)
+	return nil
+}
+
+//getHeadlessExternal sends the render job to an external render service (i.e. rendora render-server)
+func (R *Rendora) getHeadlessExternal(uri string, variant pageVariant) (*HeadlessResponse, error) {
 	bd := reqBody{
-		URL: Rendora.C.Target.URL + uri,
+		URL:    R.renderURL(uri, variant),
+		Mobile: variant.mobile,
 	}
 
 	s, err := json.Marshal(bd)
@@ -50,58 +95,130 @@ func getHeadlessExternal(uri string) (*HeadlessResponse, error) {
 		return nil, err
 	}
 
-	req, err := http.NewRequest(http.MethodGet, Rendora.C.Headless.URL+"/pages", bytes.NewBuffer(s))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Rendora-Auth", Rendora.C.Headless.AuthToken)
+	req, err := http.NewRequest(http.MethodPost, R.c.Headless.URL+"/pages", bytes.NewBuffer(s))
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Rendora-Auth", R.c.Headless.AuthToken)
 
-	resp, err := client.Do(req)
+	resp, err := R.externalClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
+	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("unsuccessful result with code:  %d", resp.StatusCode)
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
 	var ret HeadlessResponse
-	err = json.Unmarshal(body, &ret)
+	err = json.NewDecoder(resp.Body).Decode(&ret)
 	if err != nil {
 		return nil, err
 	}
 
+	if R.c.Server.Enable {
+		R.metrics.Duration.Observe(ret.Latency)
+	}
+
 	return &ret, nil
 }
 
-*/
-
 var targetURL string
 
-func (R *Rendora) getHeadless(uri string) (*HeadlessResponse, error) {
-	return R.h.getResponse(R.c.Target.URL + uri)
+func (R *Rendora) getHeadless(uri string, variant pageVariant) (*HeadlessResponse, error) {
+	// render servers always use their local headless Chrome instance even if their config is in the external mode
+	if R.isHeadlessExternal() && !R.renderServer {
+		return R.getHeadlessExternal(uri, variant)
+	}
+	return R.h.getResponse(R.renderURL(uri, variant), variant.mobile)
 }
 
-func (R *Rendora) getResponse(uri string) (*HeadlessResponse, error) {
-	cKey := R.c.Cache.Redis.KeyPrefix + ":" + uri
-	resp, exists, err := R.cache.get(cKey)
+//getResponse returns the cached HeadlessResponse of the uri or renders it, track is set for the requests of clients
+//so that popular pages can be refreshed
+func (R *Rendora) getResponse(uri string, variant pageVariant, track bool) (*HeadlessResponse, error) {
+	cKey := R.cacheKey(uri, variant)
+	entry, exists, err := R.cache.get(cKey)
 
 	if err != nil {
 		log.Println(err)
 	}
 
+	if track {
+		var expiresAt time.Time
+		if exists {
+			expiresAt = entry.ExpiresAt
+		}
+		R.trackHit(cKey, uri, variant, expiresAt)
+	}
+
 	if exists {
-		return resp, nil
+		if !entry.isStale() {
+			return entry.Response, nil
+		}
+
+		if R.c.Cache.StaleWhileRevalidate {
+			go R.revalidate(cKey, uri, variant)
+			R.countStale()
+			return entry.Response, nil
+		}
+	}
+
+	dt, err := R.renderShared(cKey, uri, variant)
+	if err == nil && dt.Status >= http.StatusInternalServerError {
+		err = fmt.Errorf("unsuccessful result with code: %d", dt.Status)
+		if !exists {
+			return dt, nil
+		}
+	}
+	if err != nil {
+		if exists {
+			log.Printf("Rendering %s failed, serving the stale cached response: %v\n", uri, err)
+			R.countStale()
+			return entry.Response, nil
+		}
+		return nil, err
 	}
 
-	dt, err := R.getHeadless(uri)
+	return dt, nil
+}
+
+//renderShared renders the uri, concurrent calls with the same key wait for a single render and share its HeadlessResponse
+func (R *Rendora) renderShared(cKey, uri string, variant pageVariant) (*HeadlessResponse, error) {
+	rendered := false
+	dt, err, _ := R.renders.Do(cKey, func() (interface{}, error) {
+		rendered = true
+		return R.render(cKey, uri, variant)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !rendered && R.c.Server.Enable {
+		R.metrics.CountSSRCoalesced.Inc()
+	}
+
+	return dt.(*HeadlessResponse), nil
+}
+
+//revalidate renders a stale cached uri in the background
+func (R *Rendora) revalidate(cKey, uri string, variant pageVariant) {
+	if _, err := R.renderShared(cKey, uri, variant); err != nil {
+		log.Printf("Revalidating %s failed: %v\n", uri, err)
+	}
+}
+
+func (R *Rendora) countStale() {
+	if R.c.Server.Enable {
+		R.metrics.CountSSRStale.Inc()
+	}
+}
+
+//render renders the uri using the headless Chrome instance and stores the HeadlessResponse in the cache
+func (R *Rendora) render(cKey, uri string, variant pageVariant) (*HeadlessResponse, error) {
+	dt, err := R.getHeadless(uri, variant)
 	if err != nil {
 		return nil, err
 	}
@@ -115,13 +232,27 @@ func (R *Rendora) getResponse(uri string) (*HeadlessResponse, error) {
 		}
 	}
 
-	defer R.cache.set(cKey, dt)
+	timeout, cacheable := R.cacheTimeout(uri, dt)
+	R.trackRender(cKey, time.Now().Add(timeout), cacheable)
+	if !cacheable {
+		return dt, nil
+	}
+
+	tags := R.pageTags(dt)
+	if R.c.Cache.Compression == "gzip" {
+		if err = dt.compress(); err != nil {
+			return nil, err
+		}
+	}
+	if err = R.cache.set(cKey, dt, timeout, tags); err != nil {
+		log.Println(err)
+	}
 	return dt, nil
 }
 
 func (R *Rendora) getSSR(c *gin.Context) {
 
-	resp, err := R.getResponse(c.Request.RequestURI)
+	resp, err := R.getResponse(c.Request.RequestURI, R.requestVariant(c.Request), true)
 	if err != nil {
 		c.AbortWithStatus(http.StatusServiceUnavailable)
 		return
@@ -133,10 +264,55 @@ func (R *Rendora) getSSR(c *gin.Context) {
 	}
 
 	c.Header("Content-Type", contentHdr)
-	c.String(resp.Status, resp.Content)
+
+	if resp.gzipped != nil {
+		c.Header("Vary", "Accept-Encoding")
+	}
+
+	if resp.gzipped != nil && acceptsGzip(c.GetHeader("Accept-Encoding")) {
+		c.Header("Content-Encoding", "gzip")
+		c.Data(resp.Status, contentHdr, resp.gzipped)
+	} else {
+		if err = resp.decompress(); err != nil {
+			log.Println(err)
+			c.AbortWithStatus(http.StatusServiceUnavailable)
+			return
+		}
+		c.String(resp.Status, resp.Content)
+	}
 
 	if R.c.Server.Enable {
 		R.metrics.CountSSR.Inc()
 	}
 
 }
+
+//acceptsGzip checks whether the Accept-Encoding header of the request allows gzip-compressed responses
+func acceptsGzip(acceptEncoding string) bool {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(coding, ";")
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.ToLower(strings.TrimSpace(param))
+			if strings.HasPrefix(param, "q=") {
+				var err error
+				if q, err = strconv.ParseFloat(param[2:], 64); err != nil {
+					q = 0
+				}
+			}
+		}
+
+		switch strings.ToLower(strings.TrimSpace(params[0])) {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return anyQ > 0
+}
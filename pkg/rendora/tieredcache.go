@@ -0,0 +1,179 @@
+/*
+Copyright 2018 George Badawi.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rendora
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+//tieredStore keeps the most recently used entries in a local store (L1) in front of Redis (L2) shared by all the
+//Rendora instances, writes and deletes are published to the other instances so that they drop their local copies
+type tieredStore struct {
+	l1        *localStore
+	l2        *redisStore
+	l1Timeout time.Duration
+	channel   string
+	id        string
+	//onVersion is called whenever another instance changes the cache version
+	onVersion func()
+}
+
+func newTieredStore(l1 *localStore, l2 *redisStore, l1Timeout time.Duration, channel string, onVersion func()) (*tieredStore, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	ret := &tieredStore{
+		l1:        l1,
+		l2:        l2,
+		l1Timeout: l1Timeout,
+		channel:   channel,
+		id:        hex.EncodeToString(id),
+		onVersion: onVersion,
+	}
+
+	pubsub := l2.client.Subscribe(channel, ret.versionChannel())
+	if _, err := pubsub.Receive(); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	go ret.listen(pubsub)
+
+	return ret, nil
+}
+
+//listen removes the local copies of the entries invalidated by the other instances, messages are sent as "id key"
+func (s *tieredStore) listen(pubsub *redis.PubSub) {
+	// messages published while reconnecting are lost, the L1 timeout bounds how long such entries stay outdated
+	for msg := range pubsub.Channel() {
+		parts := strings.SplitN(msg.Payload, " ", 2)
+		if len(parts) != 2 || parts[0] == s.id {
+			continue
+		}
+		if msg.Channel == s.versionChannel() {
+			if s.onVersion != nil {
+				go s.onVersion()
+			}
+			continue
+		}
+		s.l1.Delete(parts[1])
+	}
+}
+
+//versionChannel returns the channel where cache version changes are published as "id key"
+func (s *tieredStore) versionChannel() string {
+	return s.channel + "#version"
+}
+
+//invalidate tells the other instances to drop their local copy of the entry with the key cKey
+func (s *tieredStore) invalidate(cKey string) {
+	if err := s.l2.client.Publish(s.channel, s.id+" "+cKey).Err(); err != nil {
+		log.Println(err)
+	}
+}
+
+//setL1 stores the entry locally for at most the L1 timeout
+func (s *tieredStore) setL1(cKey string, entry *CacheEntry, ttl time.Duration) {
+	if ttl > s.l1Timeout {
+		ttl = s.l1Timeout
+	}
+	if ttl <= 0 {
+		return
+	}
+	s.l1.Set(cKey, entry, ttl)
+}
+
+func (s *tieredStore) Get(cKey string) (*CacheEntry, bool, error) {
+	if entry, exists, _ := s.l1.Get(cKey); exists {
+		return entry, true, nil
+	}
+
+	pipe := s.l2.client.Pipeline()
+	get := pipe.Get(cKey)
+	pttl := pipe.PTTL(cKey)
+	_, err := pipe.Exec()
+	if err == redis.Nil {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	val, err := get.Bytes()
+	if err != nil {
+		return nil, false, err
+	}
+	entry, exists, err := decodeCacheEntry(val)
+	if !exists {
+		return entry, exists, err
+	}
+
+	// the local copy must not outlive the Redis entry
+	s.setL1(cKey, entry, pttl.Val())
+	return entry, true, nil
+}
+
+func (s *tieredStore) Set(cKey string, entry *CacheEntry, ttl time.Duration) error {
+	if err := s.l2.Set(cKey, entry, ttl); err != nil {
+		return err
+	}
+	s.setL1(cKey, entry, ttl)
+	s.invalidate(cKey)
+	return nil
+}
+
+func (s *tieredStore) Delete(cKey string) error {
+	s.l1.Delete(cKey)
+	if err := s.l2.Delete(cKey); err != nil {
+		return err
+	}
+	s.invalidate(cKey)
+	return nil
+}
+
+func (s *tieredStore) GetVersion(key string) ([]byte, bool, error) {
+	return s.l2.GetVersion(key)
+}
+
+func (s *tieredStore) SetVersion(key string, state []byte) error {
+	if err := s.l2.SetVersion(key, state); err != nil {
+		return err
+	}
+	if err := s.l2.client.Publish(s.versionChannel(), s.id+" "+key).Err(); err != nil {
+		log.Println(err)
+	}
+	return nil
+}
+
+func (s *tieredStore) Scan(prefix string) ([]string, error) {
+	return s.l2.Scan(prefix)
+}
+
+func (s *tieredStore) Tag(cKey string, tagKeys []string, ttl time.Duration) error {
+	return s.l2.Tag(cKey, tagKeys, ttl)
+}
+
+func (s *tieredStore) TaggedKeys(tagKey string) ([]string, error) {
+	return s.l2.TaggedKeys(tagKey)
+}
+
+func (s *tieredStore) Untag(tagKey string, cKeys []string) error {
+	return s.l2.Untag(tagKey, cKeys)
+}
@@ -0,0 +1,284 @@
+/*
+Copyright 2018 George Badawi.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rendora
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mafredri/cdp/protocol/network"
+	"github.com/mafredri/cdp/protocol/page"
+	"github.com/mafredri/cdp/protocol/runtime"
+	"github.com/mafredri/cdp/rpcc"
+)
+
+const (
+	waitDOMContentLoaded = "domContentLoaded"
+	waitLoad             = "load"
+	waitNetworkIdle      = "networkIdle"
+	waitSelector         = "selector"
+	waitExpression       = "expression"
+)
+
+const (
+	waitPollInterval    = 100 * time.Millisecond
+	waitDefaultIdleTime = 500 * time.Millisecond
+)
+
+//waitConfig decides when the page is considered rendered
+type waitConfig struct {
+	Strategy    string
+	IdleTime    uint16 `mapstructure:"idleTime"`
+	MaxInflight uint16 `mapstructure:"maxInflight"`
+	Selector    string
+	Expression  string
+}
+
+//waitPathConfig overrides the global waitConfig for the matching paths
+type waitPathConfig struct {
+	Exact      string
+	Prefix     string
+	waitConfig `mapstructure:",squash"`
+}
+
+func (w *waitConfig) validate() error {
+	switch w.Strategy {
+	case waitDOMContentLoaded, waitLoad, waitNetworkIdle:
+	case waitSelector:
+		if w.Selector == "" {
+			return fmt.Errorf("wait strategy %s requires a selector", w.Strategy)
+		}
+	case waitExpression:
+		if w.Expression == "" {
+			return fmt.Errorf("wait strategy %s requires an expression", w.Strategy)
+		}
+	default:
+		return fmt.Errorf("unknown wait strategy: %s", w.Strategy)
+	}
+	return nil
+}
+
+//validateWaitConfig checks the global and per path wait strategies
+func (R *Rendora) validateWaitConfig() error {
+	wait := &R.c.Headless.Wait
+	if err := wait.validate(); err != nil {
+		return err
+	}
+
+	for _, p := range wait.Paths {
+		if p.Exact == "" && p.Prefix == "" {
+			return fmt.Errorf("wait path rules must have either exact or prefix set")
+		}
+		if err := p.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//getWaitConfig returns the wait strategy of the first path rule matching the url, or the global one if none matches
+func (c *headlessClient) getWaitConfig(uri string) *waitConfig {
+	wait := &c.rendora.c.Headless.Wait
+	if len(wait.Paths) == 0 {
+		return &wait.waitConfig
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return &wait.waitConfig
+	}
+	path := u.RequestURI()
+
+	for i := range wait.Paths {
+		p := &wait.Paths[i]
+		if p.Exact != "" && p.Exact == path {
+			return &p.waitConfig
+		}
+		if p.Prefix != "" && strings.HasPrefix(path, p.Prefix) {
+			return &p.waitConfig
+		}
+	}
+	return &wait.waitConfig
+}
+
+//pageWaiter holds the event streams needed by the wait strategy, they must be created before navigating
+type pageWaiter struct {
+	cfg             *waitConfig
+	domContent      page.DOMContentEventFiredClient
+	load            page.LoadEventFiredClient
+	requestSent     network.RequestWillBeSentClient
+	loadingFinished network.LoadingFinishedClient
+	loadingFailed   network.LoadingFailedClient
+	streams         []rpcc.Stream
+}
+
+func newPageWaiter(ctx context.Context, t *headlessTab, cfg *waitConfig) (*pageWaiter, error) {
+	w := &pageWaiter{
+		cfg: cfg,
+	}
+
+	var err error
+	w.domContent, err = t.C.Page.DOMContentEventFired(ctx)
+	if err != nil {
+		return nil, err
+	}
+	w.streams = append(w.streams, w.domContent)
+
+	switch cfg.Strategy {
+	case waitLoad:
+		w.load, err = t.C.Page.LoadEventFired(ctx)
+		if err != nil {
+			w.close()
+			return nil, err
+		}
+		w.streams = append(w.streams, w.load)
+	case waitNetworkIdle:
+		w.requestSent, err = t.C.Network.RequestWillBeSent(ctx)
+		if err != nil {
+			w.close()
+			return nil, err
+		}
+		w.streams = append(w.streams, w.requestSent)
+
+		w.loadingFinished, err = t.C.Network.LoadingFinished(ctx)
+		if err != nil {
+			w.close()
+			return nil, err
+		}
+		w.streams = append(w.streams, w.loadingFinished)
+
+		w.loadingFailed, err = t.C.Network.LoadingFailed(ctx)
+		if err != nil {
+			w.close()
+			return nil, err
+		}
+		w.streams = append(w.streams, w.loadingFailed)
+	}
+
+	return w, nil
+}
+
+func (w *pageWaiter) close() {
+	for _, s := range w.streams {
+		s.Close()
+	}
+}
+
+//wait blocks until the page is considered rendered according to the wait strategy
+func (w *pageWaiter) wait(ctx context.Context, t *headlessTab) error {
+	if _, err := w.domContent.Recv(); err != nil {
+		return err
+	}
+
+	switch w.cfg.Strategy {
+	case waitLoad:
+		_, err := w.load.Recv()
+		return err
+	case waitNetworkIdle:
+		return w.waitNetworkIdle(ctx)
+	case waitSelector:
+		selector, err := json.Marshal(w.cfg.Selector)
+		if err != nil {
+			return err
+		}
+		return waitJSExpression(ctx, t, "document.querySelector("+string(selector)+") !== null")
+	case waitExpression:
+		return waitJSExpression(ctx, t, w.cfg.Expression)
+	}
+	return nil
+}
+
+//isLongLivedRequest checks whether the request stays open as long as the page does, hence never finishes loading
+func isLongLivedRequest(resourceType network.ResourceType) bool {
+	return resourceType == network.ResourceTypeEventSource || resourceType == network.ResourceTypeWebSocket
+}
+
+//waitNetworkIdle waits until there are at most MaxInflight in-flight requests for IdleTime milliseconds
+func (w *pageWaiter) waitNetworkIdle(ctx context.Context) error {
+	idleTime := time.Duration(w.cfg.IdleTime) * time.Millisecond
+	if idleTime == 0 {
+		idleTime = waitDefaultIdleTime
+	}
+	maxInflight := int(w.cfg.MaxInflight)
+	inflight := make(map[network.RequestID]struct{})
+	idle := true
+
+	timer := time.NewTimer(idleTime)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-w.requestSent.Ready():
+			ev, err := w.requestSent.Recv()
+			if err != nil {
+				return err
+			}
+			if !isLongLivedRequest(ev.Type) {
+				inflight[ev.RequestID] = struct{}{}
+			}
+		case <-w.loadingFinished.Ready():
+			ev, err := w.loadingFinished.Recv()
+			if err != nil {
+				return err
+			}
+			delete(inflight, ev.RequestID)
+		case <-w.loadingFailed.Ready():
+			ev, err := w.loadingFailed.Recv()
+			if err != nil {
+				return err
+			}
+			delete(inflight, ev.RequestID)
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		// the idle time starts over only when the page becomes idle again
+		if len(inflight) > maxInflight && idle {
+			if !timer.Stop() {
+				<-timer.C
+			}
+			idle = false
+		} else if len(inflight) <= maxInflight && !idle {
+			timer.Reset(idleTime)
+			idle = true
+		}
+	}
+}
+
+//waitJSExpression polls the javascript expression until it is truthy
+func waitJSExpression(ctx context.Context, t *headlessTab, expression string) error {
+	args := runtime.NewEvaluateArgs("!!(" + expression + ")").SetReturnByValue(true)
+	for {
+		reply, err := t.C.Runtime.Evaluate(ctx, args)
+		if err != nil {
+			return err
+		}
+
+		// exceptions (e.g. undefined variables) mean that the page is not ready yet
+		if reply.ExceptionDetails == nil && string(reply.Result.Value) == "true" {
+			return nil
+		}
+
+		select {
+		case <-time.After(waitPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,374 @@
+/*
+Copyright 2018 George Badawi.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rendora
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sitemapMaxDepth = 3
+	sitemapTimeout  = 60 * time.Second
+	//sitemapMaxSize limits the size of sitemaps (after decompressing them) as allowed by the sitemap protocol
+	sitemapMaxSize = 50 << 20
+	//warmupMaxURIs limits the count of uris sent through the API
+	warmupMaxURIs = 1000000
+)
+
+var errWarmupRunning = errors.New("a warmup is already running")
+
+var sitemapClient = &http.Client{
+	Timeout: sitemapTimeout,
+}
+
+//warmupStatus represents the progress of the current (or last) warmup
+type warmupStatus struct {
+	Running    bool       `json:"running"`
+	Sitemap    string     `json:"sitemap"`
+	Total      int        `json:"total"`
+	Done       int        `json:"done"`
+	Failed     int        `json:"failed"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+type warmupState struct {
+	mtx    sync.Mutex
+	status warmupStatus
+}
+
+//sitemapDoc represents both sitemap files (i.e. urlset) and sitemap index files (i.e. sitemapindex)
+type sitemapDoc struct {
+	URLs []struct {
+		Loc string `xml:"loc"`
+	} `xml:"url"`
+	Sitemaps []struct {
+		Loc string `xml:"loc"`
+	} `xml:"sitemap"`
+}
+
+//getWarmupStatus returns a copy of the current warmup status
+func (R *Rendora) getWarmupStatus() warmupStatus {
+	R.warmup.mtx.Lock()
+	defer R.warmup.mtx.Unlock()
+	return R.warmup.status
+}
+
+func (R *Rendora) updateWarmupStatus(f func(s *warmupStatus)) {
+	R.warmup.mtx.Lock()
+	defer R.warmup.mtx.Unlock()
+	f(&R.warmup.status)
+}
+
+//defaultSitemap returns the configured sitemap
+func (R *Rendora) defaultSitemap() string {
+	if R.c.Warmup.Sitemap != "" {
+		return R.c.Warmup.Sitemap
+	}
+	return R.c.Target.URL + "/sitemap.xml"
+}
+
+//isSitemapURL checks whether the sitemap is a url rather than a local file path
+func isSitemapURL(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+//isSameOrigin checks whether both urls have the same scheme and host
+func isSameOrigin(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(ua.Scheme, ub.Scheme) && strings.EqualFold(ua.Host, ub.Host)
+}
+
+//checkWarmupSitemap checks that a sitemap sent through the API is either the configured sitemap or a url of the target
+//website, so that API clients can't read local files or make Rendora fetch arbitrary urls
+func (R *Rendora) checkWarmupSitemap(sitemap string) error {
+	if sitemap == R.defaultSitemap() {
+		return nil
+	}
+	if isSitemapURL(sitemap) && isSameOrigin(sitemap, R.c.Target.URL) {
+		return nil
+	}
+	return errors.New("the sitemap must be warmup.sitemap or a url of target.url")
+}
+
+//checkWarmupURIs checks that the uris sent through the API are request uris of the target website
+func checkWarmupURIs(uris []string) error {
+	if len(uris) > warmupMaxURIs {
+		return fmt.Errorf("at most %d uris can be warmed up at once", warmupMaxURIs)
+	}
+	for _, uri := range uris {
+		if !strings.HasPrefix(uri, "/") || strings.HasPrefix(uri, "//") {
+			return fmt.Errorf("invalid uri %q: it must be a path starting with /", uri)
+		}
+	}
+	return nil
+}
+
+//startWarmup starts rendering all the pages listed in the sitemap, or the uris if any, in the background
+func (R *Rendora) startWarmup(sitemap string, uris []string) error {
+	if sitemap == "" && len(uris) == 0 {
+		sitemap = R.defaultSitemap()
+	}
+
+	R.warmup.mtx.Lock()
+	defer R.warmup.mtx.Unlock()
+
+	if R.warmup.status.Running {
+		return errWarmupRunning
+	}
+
+	now := time.Now()
+	R.warmup.status = warmupStatus{
+		Running:   true,
+		Sitemap:   sitemap,
+		StartedAt: &now,
+	}
+
+	go R.runWarmup(sitemap, uris)
+	return nil
+}
+
+func (R *Rendora) runWarmup(sitemap string, uris []string) {
+	var err error
+	if len(uris) > 0 {
+		log.Printf("Warming up the cache using %d uris\n", len(uris))
+	} else {
+		log.Println("Warming up the cache using the sitemap", sitemap)
+		uris, err = collectSitemapURIs(sitemap, 0, make(map[string]bool))
+	}
+
+	R.updateWarmupStatus(func(s *warmupStatus) {
+		s.Total = len(uris)
+		if err != nil {
+			s.Error = err.Error()
+		}
+	})
+
+	if err == nil {
+		R.renderWarmupURIs(uris)
+	}
+
+	R.updateWarmupStatus(func(s *warmupStatus) {
+		now := time.Now()
+		s.Running = false
+		s.FinishedAt = &now
+		log.Printf("Warmup finished: %d rendered, %d failed out of %d\n", s.Done-s.Failed, s.Failed, s.Total)
+	})
+}
+
+//renderWarmupURIs renders the uris with bounded concurrency and rate
+func (R *Rendora) renderWarmupURIs(uris []string) {
+	jobs := make(chan string)
+	wg := &sync.WaitGroup{}
+
+	for i := uint16(0); i < R.c.Warmup.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for uri := range jobs {
+				_, err := R.getResponse(uri, pageVariant{}, false)
+				if err != nil {
+					log.Printf("Warming up %s failed: %v\n", uri, err)
+				}
+				R.updateWarmupStatus(func(s *warmupStatus) {
+					s.Done++
+					if err != nil {
+						s.Failed++
+					}
+				})
+			}
+		}()
+	}
+
+	var limiter <-chan time.Time
+	if R.c.Warmup.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / R.c.Warmup.Rate))
+		defer ticker.Stop()
+		limiter = ticker.C
+	}
+
+	for _, uri := range uris {
+		if limiter != nil {
+			<-limiter
+		}
+		jobs <- uri
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+//openSitemap opens a sitemap from a url or a local file, gzipped sitemaps are decompressed
+func openSitemap(src string) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	if isSitemapURL(src) {
+		resp, err := sitemapClient.Get(src)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("fetching the sitemap %s failed with code: %d", src, resp.StatusCode)
+		}
+		rc = resp.Body
+	} else {
+		f, err := os.Open(src)
+		if err != nil {
+			return nil, err
+		}
+		rc = f
+	}
+
+	// larger sitemaps are truncated, hence fail to parse, rather than filling the memory
+	if !strings.HasSuffix(src, ".gz") {
+		return &sitemapReadCloser{Reader: io.LimitReader(rc, sitemapMaxSize), src: rc}, nil
+	}
+
+	gz, err := gzip.NewReader(io.LimitReader(rc, sitemapMaxSize))
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return &sitemapReadCloser{Reader: io.LimitReader(gz, sitemapMaxSize), src: rc, gz: gz}, nil
+}
+
+//sitemapReadCloser reads a sitemap up to sitemapMaxSize and closes its source
+type sitemapReadCloser struct {
+	io.Reader
+	src io.Closer
+	gz  *gzip.Reader
+}
+
+func (s *sitemapReadCloser) Close() error {
+	if s.gz != nil {
+		s.gz.Close()
+	}
+	return s.src.Close()
+}
+
+//collectSitemapURIs returns the request uris of all the pages listed in the sitemap, following sitemap indexes
+func collectSitemapURIs(src string, depth int, seen map[string]bool) ([]string, error) {
+	if depth > sitemapMaxDepth {
+		return nil, fmt.Errorf("sitemap %s is nested too deeply", src)
+	}
+
+	rc, err := openSitemap(src)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var doc sitemapDoc
+	if err = xml.NewDecoder(rc).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("parsing the sitemap %s failed: %v", src, err)
+	}
+
+	var ret []string
+	for _, u := range doc.URLs {
+		loc, err := url.Parse(strings.TrimSpace(u.Loc))
+		if err != nil {
+			log.Printf("Skipping the invalid sitemap url %s: %v\n", u.Loc, err)
+			continue
+		}
+		uri := loc.RequestURI()
+		if !seen[uri] {
+			seen[uri] = true
+			ret = append(ret, uri)
+		}
+	}
+
+	for _, sm := range doc.Sitemaps {
+		loc := strings.TrimSpace(sm.Loc)
+		// sitemap indexes can only list sitemaps of their own website
+		if !isSitemapURL(loc) || (isSitemapURL(src) && !isSameOrigin(loc, src)) {
+			log.Printf("Skipping the sitemap %s listed in %s: it must be a url of the same website\n", loc, src)
+			continue
+		}
+
+		uris, err := collectSitemapURIs(loc, depth+1, seen)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, uris...)
+	}
+
+	return ret, nil
+}
+
+//Warm starts a warmup on the running Rendora instance through its API server and waits for it to finish, local
+//sitemap files are read here and their uris are sent to the API server since it only fetches sitemap urls
+func Warm(cfgFile, sitemap, serverURL string) error {
+	client, err := newAPIClient(cfgFile, serverURL)
+	if err != nil {
+		return err
+	}
+
+	warmupArgs := apiWarmupArgs{Sitemap: sitemap}
+	if sitemap != "" && !isSitemapURL(sitemap) {
+		uris, err := collectSitemapURIs(sitemap, 0, make(map[string]bool))
+		if err != nil {
+			return err
+		}
+		if len(uris) == 0 {
+			return fmt.Errorf("the sitemap %s doesn't list any pages", sitemap)
+		}
+		log.Printf("Read %d pages from the sitemap %s\n", len(uris), sitemap)
+		warmupArgs = apiWarmupArgs{URIs: uris}
+	}
+
+	args, err := json.Marshal(warmupArgs)
+	if err != nil {
+		return err
+	}
+
+	var status warmupStatus
+	if err = client.doJSON(http.MethodPost, "/warmup", bytes.NewReader(args), &status); err != nil {
+		return err
+	}
+
+	for status.Running {
+		log.Printf("Warming up: %d/%d done, %d failed\n", status.Done, status.Total, status.Failed)
+		time.Sleep(2 * time.Second)
+		status = warmupStatus{}
+		if err = client.doJSON(http.MethodGet, "/warmup", nil, &status); err != nil {
+			return err
+		}
+	}
+
+	if status.Error != "" {
+		return errors.New(status.Error)
+	}
+
+	log.Printf("Warmup finished: %d/%d done, %d failed\n", status.Done, status.Total, status.Failed)
+	return nil
+}